@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// User agents are sorted into classes such as "apt", "browser" or "crawler" by the rules in configs/agents.json
+// Rules are tried in order and the first match wins, agents that match no rule are "other"
+
+// agentOther is the class of agents that match no rule
+const agentOther = "other"
+
+// agentCrawler is the class of crawlers, they are watched for abuse
+const agentCrawler = "crawler"
+
+// AgentRule matches user agents with a regular expression
+type AgentRule struct {
+	// Name identifies the rule, crawlers are tracked by name
+	Name    string `json:"name"`
+	Class   string `json:"class"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// AgentRules is the format of configs/agents.json
+type AgentRules struct {
+	// Crawlers making more requests than this in an hour are flagged as abusive, 0 disables flagging
+	AbusiveRequestsPerHour int64       `json:"abusive_requests_per_hour"`
+	Rules                  []AgentRule `json:"rules"`
+}
+
+// AgentClassifier classifies user agents and watches crawlers
+type AgentClassifier struct {
+	rules   AgentRules
+	classes []string
+
+	// Agent strings repeat a lot so the result of each is cached
+	lock  sync.Mutex
+	cache map[string]*AgentRule
+}
+
+// agentCacheSize is how many distinct agents are remembered before the cache is cleared
+const agentCacheSize = 10000
+
+// agentClassifier classifies the agent of every nginx log entry, it is replaced at startup by configs/agents.json
+var agentClassifier, _ = NewAgentClassifier(AgentRules{})
+
+// LoadAgentClassifier reads and compiles the rules file
+func LoadAgentClassifier(path string) (*AgentClassifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules AgentRules
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAgentClassifier(rules)
+}
+
+// NewAgentClassifier compiles every rule
+func NewAgentClassifier(rules AgentRules) (*AgentClassifier, error) {
+	c := &AgentClassifier{
+		rules: rules,
+		cache: make(map[string]*AgentRule),
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.rules.Rules {
+		rule := &c.rules.Rules[i]
+		if rule.Name == "" || rule.Class == "" {
+			return nil, fmt.Errorf("agent rule %d needs a name and a class", i)
+		}
+
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("agent rule %q: %w", rule.Name, err)
+		}
+		rule.re = re
+
+		if !seen[rule.Class] {
+			seen[rule.Class] = true
+			c.classes = append(c.classes, rule.Class)
+		}
+	}
+	if !seen[agentOther] {
+		c.classes = append(c.classes, agentOther)
+	}
+
+	return c, nil
+}
+
+// Classes returns every class in the order they first appear in the rules
+func (c *AgentClassifier) Classes() []string {
+	return c.classes
+}
+
+// match returns the first rule that matches agent or nil
+func (c *AgentClassifier) match(agent string) *AgentRule {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if rule, ok := c.cache[agent]; ok {
+		return rule
+	}
+
+	var match *AgentRule
+	for i := range c.rules.Rules {
+		if c.rules.Rules[i].re.MatchString(agent) {
+			match = &c.rules.Rules[i]
+			break
+		}
+	}
+
+	if len(c.cache) >= agentCacheSize {
+		c.cache = make(map[string]*AgentRule)
+	}
+	c.cache[agent] = match
+	return match
+}
+
+// Classify returns the class of agent and the name of the rule it matched
+func (c *AgentClassifier) Classify(agent string) (class, name string) {
+	if agent == "" || agent == "-" {
+		return agentOther, agentOther
+	}
+
+	rule := c.match(agent)
+	if rule == nil {
+		return agentOther, agentOther
+	}
+	return rule.Class, rule.Name
+}
+
+// AgentStatistics counts requests by agent class for each distro
+type AgentStatistics map[string]map[string]int64
+
+// Add counts one request from a class
+func (stats AgentStatistics) Add(distro, class string) {
+	if stats[distro] == nil {
+		stats[distro] = make(map[string]int64)
+	}
+	stats[distro][class]++
+}
+
+// mergeAgentStatistics creates counters for every project, "other" and "total" starting from the saved values
+func mergeAgentStatistics(projects map[string]*Project, saved AgentStatistics) AgentStatistics {
+	stats := make(AgentStatistics)
+	for short := range projects {
+		stats[short] = make(map[string]int64)
+	}
+	stats["other"] = make(map[string]int64)
+	stats["total"] = make(map[string]int64)
+
+	for distro, classes := range saved {
+		if _, ok := stats[distro]; ok {
+			for class, requests := range classes {
+				stats[distro][class] = requests
+			}
+		}
+	}
+	return stats
+}
+
+// copyAgentStatistics creates a deep copy of stats
+func copyAgentStatistics(stats AgentStatistics) AgentStatistics {
+	c := make(AgentStatistics, len(stats))
+	for distro, classes := range stats {
+		c[distro] = make(map[string]int64, len(classes))
+		for class, requests := range classes {
+			c[distro][class] = requests
+		}
+	}
+	return c
+}
+
+// CrawlerActivity is how many requests a crawler made in an hour
+type CrawlerActivity struct {
+	Name     string    `json:"name"`
+	Hour     time.Time `json:"hour"`
+	Requests int64     `json:"requests"`
+	Abusive  bool      `json:"abusive"`
+}
+
+// CrawlerWatch counts the requests of each crawler in the hour of the newest log entry it has seen
+// The caller must synchronize access
+type CrawlerWatch struct {
+	crawlers map[string]*CrawlerActivity
+}
+
+func NewCrawlerWatch() *CrawlerWatch {
+	return &CrawlerWatch{crawlers: make(map[string]*CrawlerActivity)}
+}
+
+// Add counts a request from a crawler at t
+// It returns true the first time the crawler goes over limit within an hour
+func (w *CrawlerWatch) Add(name string, t time.Time, limit int64) bool {
+	hour := t.Truncate(time.Hour)
+
+	activity, ok := w.crawlers[name]
+	if !ok || activity.Hour.Before(hour) {
+		activity = &CrawlerActivity{Name: name, Hour: hour}
+		w.crawlers[name] = activity
+	} else if activity.Hour.After(hour) {
+		// Entries from an earlier hour than the one being counted are ignored
+		return false
+	}
+
+	activity.Requests++
+	if limit > 0 && !activity.Abusive && activity.Requests > limit {
+		activity.Abusive = true
+		return true
+	}
+	return false
+}
+
+// Activity returns every crawler seen in the last hour, busiest first
+func (w *CrawlerWatch) Activity() []CrawlerActivity {
+	since := time.Now().Add(-time.Hour).Truncate(time.Hour)
+
+	activity := make([]CrawlerActivity, 0, len(w.crawlers))
+	for _, crawler := range w.crawlers {
+		if !crawler.Hour.Before(since) {
+			activity = append(activity, *crawler)
+		}
+	}
+
+	sort.Slice(activity, func(i, j int) bool {
+		return activity[i].Requests > activity[j].Requests
+	})
+	return activity
+}
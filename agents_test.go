@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgentClassifier(t *testing.T) {
+	classifier, err := LoadAgentClassifier("configs/agents.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := classifier.rules.AbusiveRequestsPerHour
+	if limit <= 0 {
+		t.Fatal("configs/agents.json should flag abusive crawlers")
+	}
+
+	tests := []struct {
+		agent string
+		class string
+		name  string
+		// abusive is true if the agent is flagged once it goes over the hourly limit
+		abusive bool
+	}{
+		{"Debian APT-HTTP/1.3 (2.6.1)", "apt", "apt", false},
+		{"Debian APT-HTTP/1.3 (2.4.11) non-interactive", "apt", "apt", false},
+		{"Debian APT-CURL/1.0 (1.2.35)", "apt", "apt", false},
+		{"libdnf (Fedora Linux 39; container; Linux.x86_64)", "dnf", "dnf", false},
+		{"libdnf (Rocky Linux 9.3 (Blue Onyx); generic; Linux.x86_64)", "dnf", "dnf", false},
+		{"dnf/4.18.2", "dnf", "dnf", false},
+		{"urlgrabber/3.10 yum/3.4.3", "dnf", "dnf", false},
+		{"librepo/1.14.5 libcurl/8.2.1 OpenSSL/3.1.1 zlib/1.2.13", "dnf", "dnf", false},
+		{"pacman/6.0.2 (Linux x86_64) libalpm/13.0.2", "pacman", "pacman", false},
+		{"ZYpp 17.31.15 (curl 8.0.1) openSUSE-Tumbleweed-x86_64", "zypper", "zypper", false},
+		{"apk-tools/2.14.0, libfetch/2.33", "apk", "apk", false},
+		{`pip/23.3.1 {"ci":null,"cpu":"x86_64","implementation":{"name":"CPython","version":"3.11.6"},"installer":{"name":"pip","version":"23.3.1"}}`, "pip", "pip", false},
+		{"conda/23.9.0 requests/2.31.0 CPython/3.11.5 Linux/6.5.0-14-generic ubuntu/22.04.3 glibc/2.35 solver/libmamba conda-libmamba-solver/23.9.1 libmambapy/1.5.1", "pip", "pip", false},
+		{"curl/8.4.0", "curl", "curl", false},
+		{"Wget/1.21.4", "curl", "curl", false},
+		{"aria2/1.36.0", "curl", "curl", false},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", "browser", "browser", false},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "browser", "browser", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", "browser", "browser", false},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "crawler", "Googlebot", true},
+		{"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.6045.199 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "crawler", "Googlebot", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "crawler", "bingbot", true},
+		{"Mozilla/5.0 (Linux; Android 5.0) AppleWebKit/537.36 (KHTML, like Gecko) Mobile Safari/537.36 (compatible; Bytespider; spider-feedback@bytedance.com)", "crawler", "Bytespider", true},
+		{"Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; GPTBot/1.2; +https://openai.com/gptbot)", "crawler", "GPTBot", true},
+		{"Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; ClaudeBot/1.0; +claudebot@anthropic.com)", "crawler", "ClaudeBot", true},
+		{"CCBot/2.0 (https://commoncrawl.org/faq/)", "crawler", "CCBot", true},
+		{"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)", "crawler", "AhrefsBot", true},
+		{"Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)", "crawler", "YandexBot", true},
+		{"Mozilla/5.0 (compatible; SeznamBot/4.0; +https://o-seznam.cz/napoveda/vyhledavani/en/seznambot-intro/)", "crawler", "other crawlers", true},
+		{"Go-http-client/1.1", "other", "other", false},
+		{"python-requests/2.31.0", "other", "other", false},
+		{"-", "other", "other", false},
+		{"", "other", "other", false},
+	}
+
+	hour := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		class, name := classifier.Classify(test.agent)
+		if class != test.class || name != test.name {
+			t.Errorf("Classify(%q) = %s, %s, want %s, %s", test.agent, class, name, test.class, test.name)
+			continue
+		}
+
+		// Counted the same way HandleStatistics does, only crawlers are watched
+		abusive := false
+		if class == agentCrawler {
+			watch := NewCrawlerWatch()
+			for i := int64(0); i < limit; i++ {
+				if watch.Add(name, hour, limit) {
+					t.Errorf("%q was flagged after %d requests", test.agent, i+1)
+				}
+			}
+			abusive = watch.Add(name, hour, limit)
+		}
+		if abusive != test.abusive {
+			t.Errorf("%q: abusive is %v, want %v", test.agent, abusive, test.abusive)
+		}
+	}
+}
@@ -1,9 +1,290 @@
 package main
 
-import "github.com/gorilla/mux"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
 
-func HandleAPI(r *mux.Router) {
+	"github.com/COSI-Lab/logging"
+	"github.com/gorilla/mux"
+)
+
+// APIError is the body of every non 2xx response from the api
+type APIError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// APIProjectSummary is the short form of a project returned by /api/v1/projects
+type APIProjectSummary struct {
+	Short     string `json:"short"`
+	Name      string `json:"name"`
+	Page      string `json:"page"`
+	Official  bool   `json:"official"`
+	SyncStyle string `json:"syncStyle"`
+	HomePage  string `json:"homepage"`
+}
+
+// APIProject is the long form of a project returned by /api/v1/projects/{short}
+type APIProject struct {
+	APIProjectSummary
+	Color       string `json:"color"`
+	Icon        string `json:"icon,omitempty"`
+	PublicRsync bool   `json:"publicRsync"`
+	SyncsPerDay int    `json:"syncsPerDay,omitempty"`
+	Upstream    string `json:"upstream,omitempty"`
+	Alternative string `json:"alternative,omitempty"`
+	Torrents    string `json:"torrents,omitempty"`
+}
+
+// APIStats are the live counters for a single distro
+type APIStats struct {
+	Distro string   `json:"distro"`
+	Nginx  *NetStat `json:"nginx"`
+	// Traffic from each configured network
+	Networks map[string]*NetStat `json:"networks"`
+	Statuses *StatusClasses      `json:"statuses"`
+	// Traffic of the project's rsync module
+	Rsync *NetStat `json:"rsync,omitempty"`
+	// The most requested paths that returned 404
+	NotFound []TopKEntry `json:"notFound,omitempty"`
+}
+
+// APISyncStatus is the recent sync history of a project
+type APISyncStatus struct {
+	Short       string   `json:"short"`
+	LastSuccess *Status  `json:"lastSuccess"`
+	LastFailure *Status  `json:"lastFailure"`
+	Syncs       []Status `json:"syncs"`
+}
+
+// APIGeo is where a project's traffic came from over the last month
+type APIGeo struct {
+	Short string `json:"short"`
+	GeoSummary
+}
+
+// APIDownloads are the most popular downloads of a project
+type APIDownloads struct {
+	Short  string          `json:"short"`
+	Daily  DownloadLeaders `json:"daily"`
+	Weekly DownloadLeaders `json:"weekly"`
+}
+
+// writeJSON encodes v as the response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logging.Warn("writeJSON;", err)
+	}
+}
+
+// writeAPIError sends an APIError with the given status code
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, APIError{Status: status, Error: message})
+}
+
+func summarizeProject(project *Project) APIProjectSummary {
+	return APIProjectSummary{
+		Short:     project.Short,
+		Name:      project.Name,
+		Page:      project.Page,
+		Official:  project.Official,
+		SyncStyle: project.SyncStyle,
+		HomePage:  project.HomePage,
+	}
+}
+
+// The /api/v1/projects endpoint
+func handleAPIProjects(w http.ResponseWriter, r *http.Request) {
+	dataLock.RLock()
+	summaries := make([]APIProjectSummary, 0, len(projectsById))
+	for i := range projectsById {
+		summaries = append(summaries, summarizeProject(&projectsById[i]))
+	}
+	dataLock.RUnlock()
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// The /api/v1/projects/{short} endpoint
+func handleAPIProject(w http.ResponseWriter, r *http.Request) {
+	short := mux.Vars(r)["short"]
+
+	dataLock.RLock()
+	project, ok := projects[short]
+	if !ok {
+		dataLock.RUnlock()
+		writeAPIError(w, http.StatusNotFound, "unknown project")
+		return
+	}
+
+	response := APIProject{
+		APIProjectSummary: summarizeProject(project),
+		Color:             project.Color,
+		Icon:              project.Icon,
+		PublicRsync:       project.PublicRsync,
+		Alternative:       project.Alternative,
+		Torrents:          project.Torrents,
+	}
 
+	switch project.SyncStyle {
+	case "rsync":
+		response.SyncsPerDay = project.Rsync.SyncsPerDay
+		response.Upstream = "rsync://" + project.Rsync.Host + "/" + project.Rsync.Src
+	case "script":
+		response.SyncsPerDay = project.Script.SyncsPerDay
+	case "static":
+		response.Upstream = project.Static.Source
+	}
+	dataLock.RUnlock()
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// The /api/v1/stats/{distro} endpoint
+// distro can also be "total" or "other"
+func handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	distro := mux.Vars(r)["distro"]
+
+	statistics.RLock()
+	defer statistics.RUnlock()
+
+	if statistics.nginx == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "statistics are not being tracked")
+		return
+	}
+
+	nginx, ok := statistics.nginx[distro]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown distro")
+		return
+	}
+
+	// Copy the counters so they can be encoded after the lock is released
+	response := APIStats{Distro: distro}
+	nginxCopy := *nginx
+	response.Nginx = &nginxCopy
+	response.Networks = make(map[string]*NetStat, len(statistics.networks))
+	for name, network := range statistics.networks {
+		if stat, ok := network[distro]; ok {
+			statCopy := *stat
+			response.Networks[name] = &statCopy
+		}
+	}
+	if classes, ok := statistics.statuses[distro]; ok {
+		classesCopy := *classes
+		response.Statuses = &classesCopy
+	}
+	if rsync, ok := statistics.rsyncd[distro]; ok && rsync.Requests > 0 {
+		rsyncCopy := *rsync
+		response.Rsync = &rsyncCopy
+	}
+	if notFound, ok := statistics.notFound[distro]; ok {
+		response.NotFound = notFound.Top(notFoundShown)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// The /api/v1/sync/{short}/status endpoint
+func handleAPISyncStatus(w http.ResponseWriter, r *http.Request) {
+	short := mux.Vars(r)["short"]
+
+	dataLock.RLock()
+	_, ok := projects[short]
+	status := syncStatus
+	dataLock.RUnlock()
+
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown project")
+		return
+	}
+
+	if status == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "the sync scheduler is not running")
+		return
+	}
+
+	if _, ok := status[short]; !ok {
+		writeAPIError(w, http.StatusNotFound, "project is not synced by the scheduler")
+		return
+	}
+
+	response := APISyncStatus{Short: short, Syncs: status.History(short)}
+	if success, ok := status.LastSuccess(short); ok {
+		response.LastSuccess = &success
+	}
+	if failure, ok := status.LastFailure(short); ok {
+		response.LastFailure = &failure
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// The /api/v1/geo/{short} endpoint
+// short can also be "total"
+func handleAPIGeo(w http.ResponseWriter, r *http.Request) {
+	short := mux.Vars(r)["short"]
+
+	summary, ok, tracking := geoSummary(short)
+	if !tracking {
+		writeAPIError(w, http.StatusServiceUnavailable, "statistics are not being tracked")
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown project")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APIGeo{Short: short, GeoSummary: summary})
+}
+
+// The /api/v1/downloads/{short}?limit={n} endpoint
+// short can also be "total", limit defaults to 10
+func handleAPIDownloads(w http.ResponseWriter, r *http.Request) {
+	short := mux.Vars(r)["short"]
+
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > downloadsTracked {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", downloadsTracked))
+			return
+		}
+		limit = n
+	}
+
+	daily, weekly, ok, tracking := downloadLeaders(short, limit)
+	if !tracking {
+		writeAPIError(w, http.StatusServiceUnavailable, "statistics are not being tracked")
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown project")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APIDownloads{Short: short, Daily: daily, Weekly: weekly})
 }
 
-// api/stats/{distro}
+// HandleAPI registers the read only JSON api on r
+// All routes are versioned, the current version is /v1
+func HandleAPI(r *mux.Router) {
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/projects", handleAPIProjects)
+	v1.HandleFunc("/projects/{short}", handleAPIProject)
+	v1.HandleFunc("/stats/{distro}", handleAPIStats)
+	v1.HandleFunc("/sync/{short}/status", handleAPISyncStatus)
+	v1.HandleFunc("/geo/{short}", handleAPIGeo)
+	v1.HandleFunc("/downloads/{short}", handleAPIDownloads)
+
+	// Anything else under /api is a json 404 rather than falling through to the static files
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "unknown api endpoint")
+	})
+}
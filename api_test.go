@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/COSI-Lab/datarithms"
+	"github.com/gorilla/mux"
+)
+
+// newAPIServer serves the api with a couple of projects loaded
+func newAPIServer(t *testing.T) *httptest.Server {
+	arch := &Project{Name: "Arch Linux", Short: "archlinux", SyncStyle: "rsync", Page: "Distributions", Official: true}
+	arch.Rsync.Host = "mirrors.kernel.org"
+	arch.Rsync.Src = "archlinux"
+	arch.Rsync.SyncsPerDay = 4
+	blender := &Project{Name: "Blender", Short: "blender", SyncStyle: "script", Page: "Software"}
+	blender.Script.SyncsPerDay = 1
+
+	dataLock.Lock()
+	oldProjects, oldProjectsById, oldStatus := projects, projectsById, syncStatus
+	projects = map[string]*Project{"archlinux": arch, "blender": blender}
+	projectsById = []Project{*arch, *blender}
+	syncStatus = nil
+	dataLock.Unlock()
+
+	statistics.Lock()
+	oldNginx := statistics.nginx
+	statistics.nginx = nil
+	statistics.Unlock()
+
+	r := mux.NewRouter()
+	HandleAPI(r.PathPrefix("/api").Subrouter())
+	server := httptest.NewServer(r)
+
+	t.Cleanup(func() {
+		server.Close()
+
+		dataLock.Lock()
+		projects, projectsById, syncStatus = oldProjects, oldProjectsById, oldStatus
+		dataLock.Unlock()
+
+		statistics.Lock()
+		statistics.nginx = oldNginx
+		statistics.Unlock()
+	})
+	return server
+}
+
+// getJSON fetches path and decodes the body into v
+func getJSON(t *testing.T, server *httptest.Server, path string, v interface{}) int {
+	t.Helper()
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET %s: Content-Type is %q", path, ct)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+// expectAPIError checks that path returns an APIError with status
+func expectAPIError(t *testing.T, server *httptest.Server, path string, status int) {
+	t.Helper()
+
+	var body APIError
+	code := getJSON(t, server, path, &body)
+	if code != status || body.Status != status || body.Error == "" {
+		t.Errorf("GET %s: got %d %+v, want %d with an error message", path, code, body, status)
+	}
+}
+
+func TestAPIProjects(t *testing.T) {
+	server := newAPIServer(t)
+
+	var summaries []APIProjectSummary
+	code := getJSON(t, server, "/api/v1/projects", &summaries)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(summaries) != 2 || summaries[0].Short != "archlinux" || summaries[1].Short != "blender" {
+		t.Fatalf("got %+v", summaries)
+	}
+	if !summaries[0].Official || summaries[0].SyncStyle != "rsync" || summaries[1].Page != "Software" {
+		t.Errorf("got %+v", summaries)
+	}
+}
+
+func TestAPIProject(t *testing.T) {
+	server := newAPIServer(t)
+
+	var project APIProject
+	code := getJSON(t, server, "/api/v1/projects/archlinux", &project)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if project.Name != "Arch Linux" || project.SyncsPerDay != 4 || project.Upstream != "rsync://mirrors.kernel.org/archlinux" {
+		t.Errorf("got %+v", project)
+	}
+
+	expectAPIError(t, server, "/api/v1/projects/nonexistent", http.StatusNotFound)
+	expectAPIError(t, server, "/api/v1/nonexistent", http.StatusNotFound)
+}
+
+func TestAPIStats(t *testing.T) {
+	server := newAPIServer(t)
+
+	// Nothing is tracked until InitStatistics has run
+	expectAPIError(t, server, "/api/v1/stats/archlinux", http.StatusServiceUnavailable)
+
+	statistics.Lock()
+	statistics.nginx = DistroStatistics{
+		"archlinux": {BytesSent: 1000, BytesRecv: 10, Requests: 2},
+		"total":     {BytesSent: 1000, BytesRecv: 10, Requests: 2},
+	}
+	statistics.Unlock()
+
+	var stats APIStats
+	code := getJSON(t, server, "/api/v1/stats/archlinux", &stats)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if stats.Distro != "archlinux" || stats.Nginx == nil || *stats.Nginx != (NetStat{BytesSent: 1000, BytesRecv: 10, Requests: 2}) {
+		t.Errorf("got %+v", stats)
+	}
+
+	expectAPIError(t, server, "/api/v1/stats/nonexistent", http.StatusNotFound)
+}
+
+func TestAPISyncStatus(t *testing.T) {
+	server := newAPIServer(t)
+
+	// The scheduler isn't running
+	expectAPIError(t, server, "/api/v1/sync/archlinux/status", http.StatusServiceUnavailable)
+
+	status := RSYNCStatus{"archlinux": datarithms.CircularQueueInit[Status](8)}
+	status.push("archlinux", Status{StartTime: 100, EndTime: 200, ExitCode: 0})
+	status.push("archlinux", Status{StartTime: 300, EndTime: 400, ExitCode: 23})
+	WebserverLoadSyncStatus(status)
+
+	var sync APISyncStatus
+	code := getJSON(t, server, "/api/v1/sync/archlinux/status", &sync)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(sync.Syncs) != 2 || sync.LastSuccess == nil || sync.LastSuccess.StartTime != 100 || sync.LastFailure == nil || sync.LastFailure.ExitCode != 23 {
+		t.Errorf("got %+v", sync)
+	}
+
+	// blender is a project but not in the scheduler's history
+	expectAPIError(t, server, "/api/v1/sync/blender/status", http.StatusNotFound)
+	expectAPIError(t, server, "/api/v1/sync/nonexistent/status", http.StatusNotFound)
+}
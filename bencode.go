@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// A decoder for bencode, the encoding of .torrent files
+// http://bittorrent.org/beps/bep_0003.html#bencoding
+// Byte strings are decoded to string, integers to int64, lists to []interface{} and dictionaries to map[string]interface{}
+
+// maxBencodeDepth stops deeply nested input from exhausting the stack
+const maxBencodeDepth = 64
+
+// torrentMaxPieceLength is the largest piece length accepted, a piece is read into memory to be verified
+// The smallest is torrentBlockSize and every piece length in between must be a power of two
+const torrentMaxPieceLength = 64 * 1024 * 1024
+
+var errBencodeEOF = errors.New("bencode: unexpected end of input")
+
+// bencodeDecoder keeps track of where in the input it is
+type bencodeDecoder struct {
+	data []byte
+	pos  int
+	// info is the raw info dictionary of a torrent, the info hash is its sha1
+	info []byte
+}
+
+// DecodeBencode decodes a single bencoded value that must take up all of data
+func DecodeBencode(data []byte) (interface{}, error) {
+	d := &bencodeDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("bencode: %d bytes of trailing data", len(data)-d.pos)
+	}
+	return v, nil
+}
+
+func (d *bencodeDecoder) value(depth int) (interface{}, error) {
+	if depth > maxBencodeDepth {
+		return nil, errors.New("bencode: nested too deeply")
+	}
+	if d.pos >= len(d.data) {
+		return nil, errBencodeEOF
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.integer('e')
+	case c == 'l':
+		d.pos++
+		list := make([]interface{}, 0)
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errBencodeEOF
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errBencodeEOF
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+
+			start := d.pos
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+
+			// Only the info dictionary at the top of a torrent is kept
+			if depth == 0 && key == "info" {
+				d.info = d.data[start:d.pos]
+			}
+		}
+	case c >= '0' && c <= '9':
+		return d.string()
+	default:
+		return nil, fmt.Errorf("bencode: unexpected %q at offset %d", c, d.pos)
+	}
+}
+
+// integer reads digits up to end
+func (d *bencodeDecoder) integer(end byte) (int64, error) {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] != end {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return 0, errBencodeEOF
+	}
+
+	n, err := strconv.ParseInt(string(d.data[start:d.pos]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bencode: bad integer at offset %d", start)
+	}
+	d.pos++
+	return n, nil
+}
+
+// string reads a byte string such as "4:spam"
+func (d *bencodeDecoder) string() (string, error) {
+	start := d.pos
+	n, err := d.integer(':')
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n > int64(len(d.data)-d.pos) {
+		return "", fmt.Errorf("bencode: bad string length at offset %d", start)
+	}
+
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s, nil
+}
+
+// EncodeBencode encodes strings, byte slices, integers, lists and dictionaries, dictionary keys are sorted as bencode requires
+func EncodeBencode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeBencode(&buf, v)
+	return buf.Bytes(), err
+}
+
+func encodeBencode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.Write(v)
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case []string:
+		buf.WriteByte('l')
+		for _, item := range v {
+			encodeBencode(buf, item)
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			err := encodeBencode(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			encodeBencode(buf, key)
+			err := encodeBencode(buf, v[key])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: can't encode %T", v)
+	}
+	return nil
+}
+
+// TorrentFile is one of the files shared by a torrent
+type TorrentFile struct {
+	Length int64
+	Path   []string
+}
+
+// TorrentInfo is the part of a torrent's info dictionary used to check its payload
+type TorrentInfo struct {
+	Name        string
+	PieceLength int64
+	// Pieces are the sha1 hashes of each piece, 20 bytes each
+	Pieces string
+	// Length is set for torrents of a single file, Files for torrents of a directory
+	Length int64
+	Files  []TorrentFile
+	// InfoHash is the hex sha1 of the info dictionary, transmission's hashString
+	InfoHash string
+}
+
+// ParseTorrentFile reads the info dictionary of a .torrent file
+func ParseTorrentFile(torrentPath string) (*TorrentInfo, error) {
+	data, err := os.ReadFile(torrentPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTorrent(data)
+}
+
+// ParseTorrent reads the info dictionary of a bencoded torrent
+func ParseTorrent(data []byte) (*TorrentInfo, error) {
+	d := &bencodeDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+
+	metainfo, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent: not a dictionary")
+	}
+	dict, ok := metainfo["info"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent: missing info dictionary")
+	}
+
+	hash := sha1.Sum(d.info)
+	info := &TorrentInfo{InfoHash: hex.EncodeToString(hash[:])}
+
+	info.Name, ok = dict["name"].(string)
+	if !ok {
+		return nil, errors.New("torrent: missing name")
+	}
+	info.PieceLength, ok = dict["piece length"].(int64)
+	if !ok {
+		return nil, errors.New("torrent: missing piece length")
+	}
+	// Torrents are scraped from the internet, a huge piece length would be allocated by VerifyFile
+	if info.PieceLength < torrentBlockSize || info.PieceLength > torrentMaxPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("torrent: piece length %d is not a power of two between 16 KiB and 64 MiB", info.PieceLength)
+	}
+	info.Pieces, ok = dict["pieces"].(string)
+	if !ok || len(info.Pieces)%sha1.Size != 0 {
+		return nil, errors.New("torrent: missing pieces")
+	}
+
+	if length, ok := dict["length"].(int64); ok {
+		if length < 0 {
+			return nil, errors.New("torrent: negative length")
+		}
+		info.Length = length
+	} else if files, ok := dict["files"].([]interface{}); ok {
+		for _, f := range files {
+			file, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("torrent: bad file")
+			}
+			length, ok := file["length"].(int64)
+			if !ok || length < 0 {
+				return nil, errors.New("torrent: file without length")
+			}
+			parts, _ := file["path"].([]interface{})
+			path := make([]string, 0, len(parts))
+			for _, part := range parts {
+				s, ok := part.(string)
+				if !ok {
+					return nil, errors.New("torrent: bad file path")
+				}
+				path = append(path, s)
+			}
+			info.Files = append(info.Files, TorrentFile{Length: length, Path: path})
+		}
+	} else {
+		return nil, errors.New("torrent: neither length nor files are set")
+	}
+
+	return info, nil
+}
+
+// VerifyFile checks that file is the payload of a single file torrent
+// The length is always checked, the piece hashes only if pieces is true because it reads the whole file
+// Hashing stops with ctx's error once it is cancelled
+func (info *TorrentInfo) VerifyFile(ctx context.Context, file string, pieces bool) error {
+	if info.Files != nil {
+		return errors.New("torrents of more than one file can't be verified")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != info.Length {
+		return fmt.Errorf("size is %d bytes but the torrent expects %d", stat.Size(), info.Length)
+	}
+
+	expected := info.Length / info.PieceLength
+	if info.Length%info.PieceLength != 0 {
+		expected++
+	}
+	if int64(len(info.Pieces)/sha1.Size) != expected {
+		return fmt.Errorf("the torrent has %d pieces but %d are needed", len(info.Pieces)/sha1.Size, expected)
+	}
+	if !pieces {
+		return nil
+	}
+
+	// Report the first few bad pieces, a half synced file has many
+	var bad []int64
+	buf := make([]byte, info.PieceLength)
+	for i := int64(0); i < expected; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		hash := sha1.Sum(buf[:n])
+		if string(hash[:]) != info.Pieces[i*sha1.Size:(i+1)*sha1.Size] {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) > 0 {
+		if len(bad) > 5 {
+			return fmt.Errorf("%d of %d pieces don't match, starting with %v", len(bad), expected, bad[:5])
+		}
+		return fmt.Errorf("pieces %v of %d don't match", bad, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBencodeRoundTrip(t *testing.T) {
+	value := map[string]interface{}{
+		"announce": "http://tracker.example.org/announce",
+		"count":    int64(-42),
+		"empty":    "",
+		"list":     []interface{}{"spam", int64(0), []interface{}{}},
+		"nested":   map[string]interface{}{"b": int64(1), "a": "x"},
+	}
+
+	data, err := EncodeBencode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys are sorted
+	want := "d8:announce35:http://tracker.example.org/announce5:counti-42e5:empty0:4:listl4:spami0elee6:nestedd1:a1:x1:bi1eee"
+	if string(data) != want {
+		t.Errorf("encoded %q, want %q", data, want)
+	}
+
+	decoded, err := DecodeBencode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, value) {
+		t.Errorf("decoded %#v", decoded)
+	}
+}
+
+func TestBencodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"truncated integer", "i42"},
+		{"truncated string", "10:spam"},
+		{"truncated list", "l4:spam"},
+		{"truncated dictionary", "d3:key"},
+		{"dictionary without value", "d3:keye"},
+		{"bad integer", "i4x2e"},
+		{"negative string length", "-1:x"},
+		{"unknown type", "x"},
+		{"trailing data", "i1ei2e"},
+		{"nested too deeply", strings.Repeat("l", maxBencodeDepth+2) + strings.Repeat("e", maxBencodeDepth+2)},
+	}
+
+	for _, test := range tests {
+		_, err := DecodeBencode([]byte(test.data))
+		if err == nil {
+			t.Errorf("%s: %q was decoded", test.name, test.data)
+		}
+	}
+
+	// The deepest nesting allowed still decodes
+	nested := strings.Repeat("l", maxBencodeDepth+1) + strings.Repeat("e", maxBencodeDepth+1)
+	_, err := DecodeBencode([]byte(nested))
+	if err != nil {
+		t.Errorf("%d nested lists: %v", maxBencodeDepth+1, err)
+	}
+}
+
+// testPieces is the sha1 of each piece of a payload whose piece i is filled with the byte i
+func testPieces(pieces int, pieceLength int) string {
+	var hashes []byte
+	for i := 0; i < pieces; i++ {
+		hash := sha1.Sum(bytes.Repeat([]byte{byte(i)}, pieceLength))
+		hashes = append(hashes, hash[:]...)
+	}
+	return string(hashes)
+}
+
+func TestParseTorrentInfoHash(t *testing.T) {
+	// The info hash was computed separately from the bencoded info dictionary
+	info := "d6:lengthi1048576e4:name8:test.iso12:piece lengthi262144e6:pieces80:" + testPieces(4, 262144) + "e"
+	torrent, err := ParseTorrent([]byte("d8:announce32:http://tracker.example.org:6969/7:comment4:test4:info" + info + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.InfoHash != "702465962f8158bfae674bdb9529f72f94c240a9" {
+		t.Errorf("info hash is %s", torrent.InfoHash)
+	}
+	if torrent.Name != "test.iso" || torrent.Length != 1048576 || torrent.PieceLength != 262144 || len(torrent.Pieces) != 80 {
+		t.Errorf("got %+v", torrent)
+	}
+}
+
+func TestParseTorrentInvalid(t *testing.T) {
+	pieces := "6:pieces20:" + testPieces(1, 1)
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not a dictionary", "l4:infoe"},
+		{"no info", "d7:comment4:teste"},
+		{"no name", "d4:infod6:lengthi1e12:piece lengthi16384e" + pieces + "ee"},
+		{"no piece length", "d4:infod6:lengthi1e4:name4:test" + pieces + "ee"},
+		{"piece length too small", "d4:infod6:lengthi1e4:name4:test12:piece lengthi8192e" + pieces + "ee"},
+		{"piece length too large", "d4:infod6:lengthi1e4:name4:test12:piece lengthi1099511627776e" + pieces + "ee"},
+		{"piece length not a power of two", "d4:infod6:lengthi1e4:name4:test12:piece lengthi20000e" + pieces + "ee"},
+		{"pieces not a multiple of 20", "d4:infod6:lengthi1e4:name4:test12:piece lengthi16384e6:pieces3:abcee"},
+		{"negative length", "d4:infod6:lengthi-1e4:name4:test12:piece lengthi16384e" + pieces + "ee"},
+		{"no length or files", "d4:infod4:name4:test12:piece lengthi16384e" + pieces + "ee"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseTorrent([]byte(test.data))
+		if err == nil {
+			t.Errorf("%s: the torrent was accepted", test.name)
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	const pieceLength = 16384
+
+	// Three pieces, the last one short
+	var payload []byte
+	for i := 0; i < 3; i++ {
+		payload = append(payload, bytes.Repeat([]byte{byte(i)}, pieceLength)...)
+	}
+	payload = payload[:2*pieceLength+100]
+	var hashes []byte
+	for i := 0; i < len(payload); i += pieceLength {
+		end := i + pieceLength
+		if end > len(payload) {
+			end = len(payload)
+		}
+		hash := sha1.Sum(payload[i:end])
+		hashes = append(hashes, hash[:]...)
+	}
+
+	metainfo, err := EncodeBencode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "test.iso",
+			"length":       len(payload),
+			"piece length": pieceLength,
+			"pieces":       hashes,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := ParseTorrent(metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		file := filepath.Join(dir, name)
+		err := os.WriteFile(file, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	ctx := context.Background()
+
+	good := write("good.iso", payload)
+	if err := torrent.VerifyFile(ctx, good, true); err != nil {
+		t.Errorf("good file: %v", err)
+	}
+
+	short := write("short.iso", payload[:len(payload)-1])
+	if err := torrent.VerifyFile(ctx, short, false); err == nil || !strings.Contains(err.Error(), "size") {
+		t.Errorf("short file: %v", err)
+	}
+
+	corrupt := append([]byte{}, payload...)
+	corrupt[pieceLength+5] ^= 0xff
+	corruptFile := write("corrupt.iso", corrupt)
+	if err := torrent.VerifyFile(ctx, corruptFile, true); err == nil || !strings.Contains(err.Error(), "pieces [1] of 3") {
+		t.Errorf("corrupt file: %v", err)
+	}
+	// Without pieces only the size is checked
+	if err := torrent.VerifyFile(ctx, corruptFile, false); err != nil {
+		t.Errorf("corrupt file without pieces: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := torrent.VerifyFile(cancelled, good, true); err != context.Canceled {
+		t.Errorf("cancelled: %v", err)
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
+	"path/filepath"
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/COSI-Lab/logging"
 	"github.com/xeipuuv/gojsonschema"
@@ -21,6 +21,15 @@ type ConfigFile struct {
 	Schema   string              `json:"$schema"`
 	Mirrors  map[string]*Project `json:"mirrors"`
 	Torrents []*Torrent          `json:"torrents"`
+	// How many times a day torrents are scraped and synced, starting at midnight. Defaults to 1
+	TorrentSyncsPerDay int `json:"torrent_syncs_per_day"`
+	// Settings of the torrents generated for projects with a torrent_generate glob
+	TorrentGenerator TorrentGenerator `json:"torrent_generator"`
+	// Networks whose traffic is counted separately
+	Networks []*NetworkGroup `json:"networks"`
+
+	// Problems with the tokens file that don't stop it from being used
+	tokenWarnings []string
 }
 
 type Torrent struct {
@@ -92,11 +101,15 @@ type Project struct {
 	SyncStyle string // "script" "rsync" or "static"
 	Script    struct {
 		// Map of envirment variables to be set before calling the command
-		Env         map[string]string `json:"env"`
-		Command     string            `json:"command"`
-		Arguments   []string          `json:"arguments"`
-		SyncsPerDay int               `json:"syncs_per_day"`
-	}
+		Env       map[string]string `json:"env"`
+		Command   string            `json:"command"`
+		Arguments []string          `json:"arguments"`
+		// Working directory of the command
+		Dir string `json:"dir"`
+		// If true Command is a full command line that is split into the program and its arguments
+		Split       bool `json:"split"`
+		SyncsPerDay int  `json:"syncs_per_day"`
+	} `json:"script"`
 	Rsync struct {
 		Options      string `json:"options"` // cmdline options for first stage
 		Second       string `json:"second"`  // cmdline options for second stage
@@ -115,54 +128,75 @@ type Project struct {
 		Source      string `json:"source"`
 		Description string `json:"description"`
 	} `json:"static"`
-	Color       string `json:"color"`
-	Official    bool   `json:"official"`
-	Page        string `json:"page"`
-	HomePage    string `json:"homepage"`
-	PublicRsync bool   `json:"publicRsync"`
-	Icon        string `json:"icon"`
-	Alternative string `json:"alternative"`
-	AccessToken string // Loaded from the access tokens file
-	Torrents    string `json:"torrents"`
+	Color        string        `json:"color"`
+	Official     bool          `json:"official"`
+	Page         string        `json:"page"`
+	HomePage     string        `json:"homepage"`
+	PublicRsync  bool          `json:"publicRsync"`
+	Icon         string        `json:"icon"`
+	Alternative  string        `json:"alternative"`
+	AccessTokens []AccessToken // Loaded from the access tokens file
+	Torrents     string        `json:"torrents"`
+	// Glob of files to create torrents for when upstream doesn't publish them
+	TorrentGenerate string `json:"torrent_generate"`
+	Timeout         string `json:"timeout"`
+
+	// Parsed from Timeout or SYNC_TIMEOUT if it's not set
+	SyncTimeout time.Duration
+}
+
+// ConfigError lists everything that is wrong with a config file
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid config:\n- " + strings.Join(e, "\n- ")
 }
 
-func ParseConfig(configFile, schemaFile, tokensFile string) (config ConfigFile) {
+// ParseConfig reads and validates the config file, the schema it must follow and the access tokens
+// Every problem found is returned as a ConfigError so a bad file can be fixed in one go
+func ParseConfig(configFile, schemaFile, tokensFile string) (*ConfigFile, error) {
 	// Parse the schema file
-	schemaBytes, err := ioutil.ReadFile(schemaFile)
+	schemaBytes, err := os.ReadFile(schemaFile)
 	if err != nil {
-		log.Fatal("Could not read schema file: ", configFile, err.Error())
+		return nil, fmt.Errorf("could not read schema file: %w", err)
 	}
 	schemaLoader := gojsonschema.NewBytesLoader(schemaBytes)
 
 	// Parse the config file
-	configBytes, err := ioutil.ReadFile(configFile)
+	configBytes, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Fatal("Could not read config file: ", configFile, err.Error())
+		return nil, fmt.Errorf("could not read config file: %w", err)
 	}
 	documentLoader := gojsonschema.NewBytesLoader(configBytes)
 
 	// Validate the config against the schema
 	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
 	if err != nil {
-		log.Fatal("Config file did not match the schema: ", err.Error())
+		return nil, fmt.Errorf("config file did not match the schema: %w", err)
 	}
 
 	// Report errors
 	if !result.Valid() {
-		fmt.Printf("The document is not valid. see errors :\n")
+		var problems ConfigError
 		for _, desc := range result.Errors() {
-			fmt.Printf("- %s\n", desc)
+			problems = append(problems, desc.String())
 		}
-		os.Exit(1)
+		return nil, problems
 	}
 
 	// Finally parse the config
-	err = json.Unmarshal(configBytes, &config)
+	config := &ConfigFile{}
+	err = json.Unmarshal(configBytes, config)
 	if err != nil {
-		log.Fatal("Could not parse the config file even though it fits the schema file: ", err.Error())
+		return nil, fmt.Errorf("could not parse the config file even though it fits the schema file: %w", err)
 	}
 
+	var problems ConfigError
+
 	// Parse passwords & copy key as short & determine style
+	if len(config.Mirrors) > 255 {
+		problems = append(problems, "too many projects, 255 is the maximum because of the live map")
+	}
 	var i uint8 = 0
 	for short, project := range config.Mirrors {
 		if project.Rsync.Dest != "" {
@@ -173,59 +207,137 @@ func ParseConfig(configFile, schemaFile, tokensFile string) (config ConfigFile)
 			project.SyncStyle = "script"
 		}
 
+		project.SyncTimeout = syncTimeout
+		if project.Timeout != "" {
+			project.SyncTimeout, err = time.ParseDuration(project.Timeout)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: could not parse the timeout: %s", short, err))
+			}
+		}
+
 		if project.Rsync.PasswordFile != "" {
-			project.Rsync.Password = getPassword("configs/" + project.Rsync.PasswordFile)
+			project.Rsync.Password, err = getPassword("configs/" + project.Rsync.PasswordFile)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", short, err))
+			}
 		}
 		project.Short = short
 		project.Id = i
-
-		// add 1 and check for overflow
-		if i == 255 {
-			log.Fatal("Too many projects, 255 is the maximum because of the live map")
-		}
 		i++
 	}
+	problems = append(problems, checkProjects(config)...)
+
+	if config.TorrentSyncsPerDay == 0 {
+		config.TorrentSyncsPerDay = 1
+	}
+
+	pieceLength := config.TorrentGenerator.PieceLength
+	if pieceLength != 0 && (pieceLength < torrentBlockSize || pieceLength&(pieceLength-1) != 0) {
+		problems = append(problems, fmt.Sprint("the torrent_generator piece_length must be a power of two of at least ", torrentBlockSize))
+	}
+
+	err = parseNetworkGroups(config.Networks)
+	if err != nil {
+		problems = append(problems, "could not parse the networks: "+err.Error())
+	}
 
 	// Parse access tokens
 	if tokensFile != "" {
-		// Read line by line
-		file, err := os.Open(tokensFile)
-		if err != nil {
-			log.Fatal("Could not open access tokens file: ", tokensFile, err.Error())
+		err = parseTokens(config, tokensFile)
+		if tokenProblems, ok := err.(ConfigError); ok {
+			problems = append(problems, tokenProblems...)
+		} else if err != nil {
+			problems = append(problems, err.Error())
 		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
+	}
 
-			// The format is "project:token" and we ignore lines that don't match
-			reg := regexp.MustCompile(`^([^:]+):([^:]+)$`)
-			if reg.MatchString(line) {
-				// Get the project name and the token
-				projectName := reg.FindStringSubmatch(line)[1]
-				token := reg.FindStringSubmatch(line)[2]
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return config, nil
+}
 
-				// Add the token to the project
-				config.Mirrors[projectName].AccessToken = token
+// checkProjects finds problems the schema can't express
+func checkProjects(config *ConfigFile) (problems []string) {
+	dests := make(map[string]string)
+	for _, project := range config.GetProjects() {
+		// Two projects syncing into the same directory would delete each other's files
+		dest := project.Rsync.Dest
+		if project.SyncStyle == "static" {
+			dest = project.Static.Location
+		}
+		if dest != "" {
+			dest = filepath.Clean(dest)
+			if other, ok := dests[dest]; ok {
+				problems = append(problems, fmt.Sprintf("%s: %s is also the destination of %s", project.Short, dest, other))
 			}
+			dests[dest] = project.Short
+		}
+
+		// The scheduler can't place a project that never syncs
+		syncs := project.Rsync.SyncsPerDay
+		if project.SyncStyle == "script" {
+			syncs = project.Script.SyncsPerDay
+		}
+		if project.SyncStyle != "static" && (syncs < 1 || syncs > 24) {
+			problems = append(problems, fmt.Sprintf("%s: syncs_per_day must be between 1 and 24, not %d", project.Short, syncs))
 		}
 	}
+	return problems
+}
+
+// Warnings returns problems that don't stop the config from being used, such as scripts that can't be found
+func (config *ConfigFile) Warnings() (warnings []string) {
+	warnings = append(warnings, config.tokenWarnings...)
+
+	for _, project := range config.GetProjects() {
+		if project.SyncStyle != "script" {
+			continue
+		}
 
-	return config
+		command, err := script(context.Background(), &project)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", project.Short, err))
+			continue
+		}
+
+		if command.Dir != "" {
+			info, err := os.Stat(command.Dir)
+			if err != nil || !info.IsDir() {
+				warnings = append(warnings, fmt.Sprintf("%s: the working directory %s does not exist", project.Short, command.Dir))
+				continue
+			}
+		}
+
+		// Commands without a slash are searched for in PATH when the command is created
+		if command.Err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", project.Short, command.Err))
+			continue
+		}
+		program := command.Path
+		if !filepath.IsAbs(program) && command.Dir != "" {
+			program = filepath.Join(command.Dir, program)
+		}
+		info, err := os.Stat(program)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", project.Short, err))
+		} else if info.IsDir() || info.Mode()&0111 == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: %s is not executable", project.Short, program))
+		}
+	}
+	return warnings
 }
 
-func getPassword(filename string) string {
+func getPassword(filename string) (string, error) {
 	bytes, err := os.ReadFile(filename)
-
 	if err != nil {
-		log.Fatal("Could not read password file: ", filename, " ", err.Error())
+		return "", fmt.Errorf("could not read password file: %w", err)
 	}
 
 	// trim whitespace from the end
 	password := strings.TrimSpace(string(bytes))
 
-	return string(password)
+	return password, nil
 }
 
 func createRsyncdConfig(config *ConfigFile) {
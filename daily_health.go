@@ -41,7 +41,7 @@ from(bucket: "public")
     |> derivative(unit: 1h, nonNegative: true)
 */
 func QueryDailyNginxStats() (*api.QueryTableResult, error) {
-	const request = "from(bucket: \"public\") |> range(start: -25h, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"nginx\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\") |> derivative(unit: 1h, nonNegative: true)"
+	request := fmt.Sprintf("from(bucket: \"%s\") |> range(start: -25h, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"nginx\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\") |> derivative(unit: 1h, nonNegative: true)", influxPublicBucket)
 
 	// try the query at most 5 times
 	for i := 0; i < 5; i++ {
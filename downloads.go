@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Popular downloads are tracked per project and for "total" in daily buckets of
+// approximate top-k counters, one by requests and one by bytes served
+
+// downloadDays is how many days of popular downloads are kept, the weekly window merges all of them
+const downloadDays = 7
+
+// downloadsTracked is how many paths each counter tracks, only the top of them are accurate
+// and downloadsSaved is how many of them are written to influxdb for each day
+const downloadsTracked = 200
+const downloadsSaved = 20
+
+// DownloadDay is the most popular downloads of a project on a single UTC day
+type DownloadDay struct {
+	Date     string `json:"date"`
+	Requests *TopK  `json:"requests"`
+	Bytes    *TopK  `json:"bytes"`
+}
+
+// ProjectDownloads is the last downloadDays days of downloads of a project from oldest to newest
+type ProjectDownloads struct {
+	Days []*DownloadDay `json:"days"`
+}
+
+type DownloadStatistics map[string]*ProjectDownloads
+
+// day returns the DownloadDay of date, creating it if it is newer than every other day
+// Days older than the window return nil
+func (d *ProjectDownloads) day(date string) *DownloadDay {
+	for i := len(d.Days) - 1; i >= 0; i-- {
+		if d.Days[i].Date == date {
+			return d.Days[i]
+		}
+		if d.Days[i].Date < date {
+			break
+		}
+	}
+
+	if len(d.Days) > 0 && d.Days[len(d.Days)-1].Date > date {
+		return nil
+	}
+
+	day := &DownloadDay{
+		Date:     date,
+		Requests: NewTopK(downloadsTracked),
+		Bytes:    NewTopK(downloadsTracked),
+	}
+	d.Days = append(d.Days, day)
+	if len(d.Days) > downloadDays {
+		d.Days = d.Days[len(d.Days)-downloadDays:]
+	}
+	return day
+}
+
+// Add counts a log entry
+// Partial responses count towards bytes but not requests so download managers aren't counted many times
+func (d *ProjectDownloads) Add(entry *NginxLogEntry) {
+	if entry.Status != http.StatusOK && entry.Status != http.StatusPartialContent {
+		return
+	}
+
+	day := d.day(entry.Time.UTC().Format("2006-01-02"))
+	if day == nil {
+		return
+	}
+
+	path, _, _ := strings.Cut(entry.Url, "?")
+	if entry.Status == http.StatusOK {
+		day.Requests.Add(path)
+	}
+	day.Bytes.AddN(path, entry.BytesSent)
+}
+
+// DownloadLeaders are the most popular downloads over a window
+type DownloadLeaders struct {
+	Requests []TopKEntry `json:"requests"`
+	Bytes    []TopKEntry `json:"bytes"`
+}
+
+// Leaders returns the top n downloads of the newest day and of every tracked day
+func (d *ProjectDownloads) Leaders(n int) (daily, weekly DownloadLeaders) {
+	daily = DownloadLeaders{Requests: []TopKEntry{}, Bytes: []TopKEntry{}}
+	weekly = daily
+	if len(d.Days) == 0 {
+		return daily, weekly
+	}
+
+	today := d.Days[len(d.Days)-1]
+	daily.Requests = today.Requests.Top(n)
+	daily.Bytes = today.Bytes.Top(n)
+
+	requests := NewTopK(downloadDays * downloadsTracked)
+	bytes := NewTopK(downloadDays * downloadsTracked)
+	for _, day := range d.Days {
+		requests.Merge(day.Requests)
+		bytes.Merge(day.Bytes)
+	}
+	weekly.Requests = requests.Top(n)
+	weekly.Bytes = bytes.Top(n)
+
+	return daily, weekly
+}
+
+// Copy returns a deep copy
+func (d *ProjectDownloads) Copy() *ProjectDownloads {
+	c := &ProjectDownloads{Days: make([]*DownloadDay, 0, len(d.Days))}
+	for _, day := range d.Days {
+		if day.Requests == nil || day.Bytes == nil {
+			continue
+		}
+		c.Days = append(c.Days, &DownloadDay{
+			Date:     day.Date,
+			Requests: day.Requests.Copy(),
+			Bytes:    day.Bytes.Copy(),
+		})
+	}
+	return c
+}
+
+// newDownloadStatistics creates empty leaderboards for every project and "total", keeping saved days
+func newDownloadStatistics(projects map[string]*Project, saved DownloadStatistics) DownloadStatistics {
+	stats := make(DownloadStatistics)
+	for short := range projects {
+		stats[short] = &ProjectDownloads{}
+	}
+	stats["total"] = &ProjectDownloads{}
+
+	for short, downloads := range saved {
+		if _, ok := stats[short]; ok && downloads != nil {
+			stats[short] = downloads.Copy()
+		}
+	}
+	return stats
+}
+
+// copyDownloadStatistics creates a deep copy of stats
+func copyDownloadStatistics(stats DownloadStatistics) DownloadStatistics {
+	c := make(DownloadStatistics, len(stats))
+	for short, downloads := range stats {
+		c[short] = downloads.Copy()
+	}
+	return c
+}
+
+// downloadLeaders returns the top n downloads of a project
+// tracking is false if statistics are not being tracked at all
+func downloadLeaders(short string, n int) (daily, weekly DownloadLeaders, ok bool, tracking bool) {
+	statistics.RLock()
+	defer statistics.RUnlock()
+
+	if statistics.downloads == nil {
+		return daily, weekly, false, false
+	}
+
+	downloads, ok := statistics.downloads[short]
+	if !ok {
+		return daily, weekly, false, true
+	}
+
+	daily, weekly = downloads.Leaders(n)
+	return daily, weekly, true, true
+}
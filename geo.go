@@ -0,0 +1,272 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Where our traffic comes from is aggregated by day for each project so we can answer
+// the university's yearly questions. Client IPs only ever enter a HyperLogLog so they are never stored.
+
+// geoDays is how many days of geographic statistics are kept for each project
+const geoDays = 31
+
+// geoUnknown is used for clients without a GeoIP result
+const geoUnknown = "unknown"
+
+// GeoDay is the traffic of a project on a single UTC day
+type GeoDay struct {
+	Date       string              `json:"date"`
+	Countries  map[string]*NetStat `json:"countries"`
+	Continents map[string]*NetStat `json:"continents"`
+	Visitors   *HyperLogLog        `json:"visitors"`
+}
+
+// ProjectGeo is the last geoDays days of traffic of a project from oldest to newest
+type ProjectGeo struct {
+	Days []*GeoDay `json:"days"`
+}
+
+type GeoStatistics map[string]*ProjectGeo
+
+func newGeoDay(date string) *GeoDay {
+	return &GeoDay{
+		Date:       date,
+		Countries:  make(map[string]*NetStat),
+		Continents: make(map[string]*NetStat),
+		Visitors:   NewHyperLogLog(),
+	}
+}
+
+// day returns the GeoDay of date, creating it if it is newer than every other day
+// Days older than the window return nil
+func (g *ProjectGeo) day(date string) *GeoDay {
+	for i := len(g.Days) - 1; i >= 0; i-- {
+		if g.Days[i].Date == date {
+			return g.Days[i]
+		}
+		if g.Days[i].Date < date {
+			break
+		}
+	}
+
+	if len(g.Days) > 0 && g.Days[len(g.Days)-1].Date > date {
+		// Old entries are only counted if their day is still being tracked
+		return nil
+	}
+
+	day := newGeoDay(date)
+	g.Days = append(g.Days, day)
+	if len(g.Days) > geoDays {
+		g.Days = g.Days[len(g.Days)-geoDays:]
+	}
+	return day
+}
+
+// Add counts a log entry
+func (g *ProjectGeo) Add(entry *NginxLogEntry) {
+	day := g.day(entry.Time.UTC().Format("2006-01-02"))
+	if day == nil {
+		return
+	}
+
+	country, continent := geoUnknown, geoUnknown
+	if entry.City != nil {
+		if entry.City.Country.ISOCode != "" {
+			country = entry.City.Country.ISOCode
+		}
+		if entry.City.Continent.Code != "" {
+			continent = entry.City.Continent.Code
+		}
+	}
+
+	addGeoStat(day.Countries, country, entry)
+	addGeoStat(day.Continents, continent, entry)
+	day.Visitors.Add(entry.IP)
+}
+
+func addGeoStat(stats map[string]*NetStat, key string, entry *NginxLogEntry) {
+	stat, ok := stats[key]
+	if !ok {
+		stat = &NetStat{}
+		stats[key] = stat
+	}
+	stat.BytesSent += entry.BytesSent
+	stat.BytesRecv += entry.BytesRecv
+	stat.Requests++
+}
+
+// Copy returns a deep copy
+func (g *ProjectGeo) Copy() *ProjectGeo {
+	c := &ProjectGeo{Days: make([]*GeoDay, len(g.Days))}
+	for i, day := range g.Days {
+		dayCopy := &GeoDay{
+			Date:       day.Date,
+			Countries:  make(map[string]*NetStat, len(day.Countries)),
+			Continents: make(map[string]*NetStat, len(day.Continents)),
+			Visitors:   NewHyperLogLog(),
+		}
+		// Merging also replaces missing or corrupt registers loaded from a snapshot
+		dayCopy.Visitors.Merge(day.Visitors)
+		for country, stat := range day.Countries {
+			statCopy := *stat
+			dayCopy.Countries[country] = &statCopy
+		}
+		for continent, stat := range day.Continents {
+			statCopy := *stat
+			dayCopy.Continents[continent] = &statCopy
+		}
+		c.Days[i] = dayCopy
+	}
+	return c
+}
+
+// GeoRow is the traffic from one country or continent
+type GeoRow struct {
+	Code string `json:"code"`
+	NetStat
+}
+
+// Sent is the human readable number of bytes sent
+func (row GeoRow) Sent() string {
+	return BytesToHumanReadableSize(row.BytesSent)
+}
+
+// GeoDaySummary is the traffic of a single day
+type GeoDaySummary struct {
+	Date     string `json:"date"`
+	Requests int64  `json:"requests"`
+	Visitors int64  `json:"visitors"`
+}
+
+// GeoSummary adds up a project's days
+type GeoSummary struct {
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Visitors   int64           `json:"visitors"`
+	Countries  []GeoRow        `json:"countries"`
+	Continents []GeoRow        `json:"continents"`
+	Days       []GeoDaySummary `json:"days"`
+}
+
+// Summary adds up every tracked day
+// Visitors is the number of unique clients over all of the days, not the sum of each day
+func (g *ProjectGeo) Summary() GeoSummary {
+	summary := GeoSummary{
+		Countries:  []GeoRow{},
+		Continents: []GeoRow{},
+		Days:       []GeoDaySummary{},
+	}
+	if len(g.Days) == 0 {
+		return summary
+	}
+
+	summary.From = g.Days[0].Date
+	summary.To = g.Days[len(g.Days)-1].Date
+
+	countries := make(map[string]*NetStat)
+	continents := make(map[string]*NetStat)
+	visitors := NewHyperLogLog()
+	for _, day := range g.Days {
+		requests := int64(0)
+		for country, stat := range day.Countries {
+			mergeGeoStat(countries, country, stat)
+			requests += stat.Requests
+		}
+		for continent, stat := range day.Continents {
+			mergeGeoStat(continents, continent, stat)
+		}
+		visitors.Merge(day.Visitors)
+
+		summary.Days = append(summary.Days, GeoDaySummary{
+			Date:     day.Date,
+			Requests: requests,
+			Visitors: day.Visitors.Count(),
+		})
+	}
+
+	summary.Visitors = visitors.Count()
+	summary.Countries = sortedGeoRows(countries)
+	summary.Continents = sortedGeoRows(continents)
+	return summary
+}
+
+func mergeGeoStat(stats map[string]*NetStat, key string, stat *NetStat) {
+	total, ok := stats[key]
+	if !ok {
+		total = &NetStat{}
+		stats[key] = total
+	}
+	total.BytesSent += stat.BytesSent
+	total.BytesRecv += stat.BytesRecv
+	total.Requests += stat.Requests
+}
+
+// sortedGeoRows returns the rows with the most requests first
+func sortedGeoRows(stats map[string]*NetStat) []GeoRow {
+	rows := make([]GeoRow, 0, len(stats))
+	for code, stat := range stats {
+		rows = append(rows, GeoRow{Code: code, NetStat: *stat})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Requests != rows[j].Requests {
+			return rows[i].Requests > rows[j].Requests
+		}
+		return rows[i].Code < rows[j].Code
+	})
+	return rows
+}
+
+// newGeoStatistics creates empty aggregates for every project and "total", keeping saved days
+func newGeoStatistics(projects map[string]*Project, saved GeoStatistics) GeoStatistics {
+	stats := make(GeoStatistics)
+	for short := range projects {
+		stats[short] = &ProjectGeo{}
+	}
+	stats["total"] = &ProjectGeo{}
+
+	for short, geo := range saved {
+		if _, ok := stats[short]; ok && geo != nil {
+			stats[short] = geo.Copy()
+		}
+	}
+	return stats
+}
+
+// copyGeoStatistics creates a deep copy of stats
+func copyGeoStatistics(stats GeoStatistics) GeoStatistics {
+	c := make(GeoStatistics, len(stats))
+	for short, geo := range stats {
+		c[short] = geo.Copy()
+	}
+	return c
+}
+
+// geoSummary summarizes a project's days
+// tracking is false if statistics are not being tracked at all
+func geoSummary(short string) (summary GeoSummary, ok bool, tracking bool) {
+	statistics.RLock()
+	defer statistics.RUnlock()
+
+	if statistics.geo == nil {
+		return summary, false, false
+	}
+
+	geo, ok := statistics.geo[short]
+	if !ok {
+		return summary, false, true
+	}
+	return geo.Summary(), true, true
+}
+
+// today returns the current day of the project, used to export daily values
+func (g *ProjectGeo) today() *GeoDay {
+	if len(g.Days) == 0 {
+		return nil
+	}
+	day := g.Days[len(g.Days)-1]
+	if day.Date != time.Now().UTC().Format("2006-01-02") {
+		return nil
+	}
+	return day
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of bits used to pick a register, 2^12 registers have a standard error of about 1.6%
+const hllPrecision = 12
+const hllRegisters = 1 << hllPrecision
+
+// HyperLogLog estimates the number of distinct values added to it without storing the values
+type HyperLogLog struct {
+	Registers []byte `json:"registers"`
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{Registers: make([]byte, hllRegisters)}
+}
+
+// hllHash hashes a value with fnv-1a and mixes the result so every bit is usable
+func hllHash(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	x := h.Sum64()
+
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add records value
+func (h *HyperLogLog) Add(value []byte) {
+	x := hllHash(value)
+	register := x >> (64 - hllPrecision)
+	// position of the first 1 bit in the remaining bits
+	rank := byte(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.Registers[register] {
+		h.Registers[register] = rank
+	}
+}
+
+// Merge adds every value that was added to other
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	if other == nil || len(other.Registers) != len(h.Registers) {
+		return
+	}
+	for i, rank := range other.Registers {
+		if rank > h.Registers[i] {
+			h.Registers[i] = rank
+		}
+	}
+}
+
+// Count estimates the number of distinct values added
+func (h *HyperLogLog) Count() int64 {
+	m := float64(len(h.Registers))
+	if m == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.Registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(estimate + 0.5)
+}
@@ -3,8 +3,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"sort"
+	"os"
 
 	"github.com/COSI-Lab/logging"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -17,17 +18,44 @@ type DataPoint *write.Point
 var writer api.WriteAPI
 var reader api.QueryAPI
 
-func SetupInfluxClients(token string) {
-	// create new client with default option for server url authenticate by token
+// influxTLSConfig verifies the server certificate against INFLUX_CA_CERT if it is set, otherwise the system roots
+func influxTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: influxInsecureSkipVerify}
+
+	if influxCACert != "" {
+		pem, err := os.ReadFile(influxCACert)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in INFLUX_CA_CERT %s", influxCACert)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+func SetupInfluxClients(token string) error {
+	tlsConfig, err := influxTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	// create new client authenticated by token
 	options := influxdb2.DefaultOptions()
-	options.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	options.SetTLSConfig(tlsConfig)
 
-	client := influxdb2.NewClientWithOptions("https://mirror.clarkson.edu:8086", token, options)
+	client := influxdb2.NewClientWithOptions(influxURL, token, options)
 
 	if !influxReadOnly {
-		writer = client.WriteAPI("COSI", "stats")
+		writer = client.WriteAPI(influxOrg, influxBucket)
 	}
-	reader = client.QueryAPI("COSI")
+	reader = client.QueryAPI(influxOrg)
+
+	return nil
 }
 
 // Gets the bytes sent for each project in the last 24 hours
@@ -45,7 +73,8 @@ func QueryBytesSentByProject() (map[string]int64, error) {
 			|> spread()
 			|> yield(name: "spread")
 	*/
-	result, err := reader.Query(context.Background(), "from(bucket: \"stats\") |> range(start: -24h, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"mirror\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\") |> spread() |> yield(name: \"spread\")")
+	request := fmt.Sprintf("from(bucket: \"%s\") |> range(start: -24h, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"mirror\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\") |> spread() |> yield(name: \"spread\")", influxBucket)
+	result, err := reader.Query(context.Background(), request)
 
 	if err != nil {
 		return nil, err
@@ -80,92 +109,3 @@ func QueryBytesSentByProject() (map[string]int64, error) {
 
 	return bytesSent, nil
 }
-
-// implements the sort interface
-type LineChart struct {
-	Sent  []float64
-	Recv  []float64
-	Times []int64
-}
-
-func (l LineChart) Len() int {
-	return len(l.Sent)
-}
-
-func (l LineChart) Swap(i, j int) {
-	l.Sent[i], l.Sent[j] = l.Sent[j], l.Sent[i]
-	l.Recv[i], l.Recv[j] = l.Recv[j], l.Recv[i]
-	l.Times[i], l.Times[j] = l.Times[j], l.Times[i]
-}
-
-func (l LineChart) Less(i, j int) bool {
-	return l.Times[i] < l.Times[j]
-}
-
-// Gets the total network bytes sent and received for the last week in 1 hour blocks
-func QueryWeeklyNetStats() (line LineChart, err error) {
-	// You can paste this into the influxdb data explorer
-	/*
-		from(bucket: "system")
-			|> range(start: -7d, stop: now())
-			|> filter(fn: (r) => r["_measurement"] == "net" and r["interface"] == "enp8s0")
-			|> filter(fn: (r) => r["_field"] == "bytes_sent" or r["_field"] == "bytes_recv")
-			|> aggregateWindow(every: 1h, fn: last)
-			|> derivative(unit: 1s, nonNegative: true)
-			|> yield(name: "nonnegative derivative")
-	*/
-	result, err := reader.Query(context.Background(), "from(bucket: \"system\") |> range(start: -7d, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"net\" and r[\"interface\"] == \"enp8s0\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\" or r[\"_field\"] == \"bytes_recv\") |> aggregateWindow(every: 1h, fn: last) |> derivative(unit: 1s, nonNegative: true) |> yield(name: \"nonnegative derivative\")")
-
-	if err != nil {
-		return LineChart{}, err
-	}
-
-	sent := make([]float64, 0)
-	recv := make([]float64, 0)
-	times := make([]int64, 0)
-
-	for result.Next() {
-		if result.Err() == nil {
-			// Get the data point
-			dp := result.Record()
-
-			// Get the field
-			field, ok := dp.ValueByKey("_field").(string)
-			if !ok {
-				logging.Warn("Error getting field")
-				fmt.Printf("%T %v\n", field, field)
-				continue
-			}
-
-			// Get the value
-			value, ok := dp.ValueByKey("_value").(float64)
-			if !ok {
-				logging.Warn("Error getting value")
-				fmt.Printf("%T %v\n", value, value)
-				continue
-			}
-
-			switch field {
-			case "bytes_sent":
-				sent = append(sent, value)
-			case "bytes_recv":
-				recv = append(recv, value)
-				times = append(times, dp.Time().Unix())
-			}
-		} else {
-			logging.Warn("InitNGINXStats Flux Query Error", result.Err())
-		}
-	}
-
-	line = LineChart{
-		Sent:  sent,
-		Recv:  recv,
-		Times: times,
-	}
-
-	fmt.Println(len(sent), len(recv), len(times))
-
-	sort.Sort(line)
-
-	return line, nil
-}
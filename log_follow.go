@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/COSI-Lab/datarithms"
+	"github.com/COSI-Lab/logging"
+)
+
+// Logs are followed with a LogCursor so that no line is lost or counted twice across restarts and log rotations
+// The cursor of the last counted entry is saved with the statistics. At startup the rotated copies of the log
+// (access.log.1, access.log.2.gz, ...) written after the cursor are read before following the live file like `tail -F`
+
+// LogCursor is a position in a log file
+type LogCursor struct {
+	// Inode identifies the file, it stays the same when logrotate renames access.log to access.log.1
+	Inode uint64 `json:"inode"`
+	// Offset is just after the last line read, in compressed files it is an offset into the decompressed data
+	Offset int64 `json:"offset"`
+	// Time is the date of the last line read, it is used when the file the cursor points into is gone or compressed
+	Time time.Time `json:"time"`
+}
+
+// logHandler receives every line of a log with the position just after it
+type logHandler func(line string, inode uint64, offset int64)
+
+// logPollInterval is how often a followed log is checked for new lines and rotation
+const logPollInterval = 250 * time.Millisecond
+
+// Lines that could not be parsed, exported by /metrics
+var nginxSkippedLines atomic.Int64
+var rsyncdSkippedLines atomic.Int64
+
+// rotatedLog is a log file or one of its rotated copies
+type rotatedLog struct {
+	path string
+	// n is the number logrotate gave the copy, 0 is the live file
+	n  int
+	gz bool
+}
+
+// rotatedLogs returns the rotated copies of logFile from oldest to newest followed by logFile itself
+// Copies must be named the way logrotate names them by default: logFile.1, logFile.2.gz, ...
+func rotatedLogs(logFile string) []rotatedLog {
+	matches, _ := filepath.Glob(logFile + ".*")
+
+	logs := make([]rotatedLog, 0, len(matches)+1)
+	for _, path := range matches {
+		suffix := strings.TrimPrefix(path, logFile+".")
+		gz := strings.HasSuffix(suffix, ".gz")
+		n, err := strconv.Atoi(strings.TrimSuffix(suffix, ".gz"))
+		if err != nil || n < 1 {
+			continue
+		}
+		logs = append(logs, rotatedLog{path: path, n: n, gz: gz})
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].n > logs[j].n
+	})
+	return append(logs, rotatedLog{path: logFile})
+}
+
+// fileInode returns the inode of a file or 0 if the platform doesn't have them
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// logPosition sends lines to a handler and keeps track of where they are in the log
+type logPosition struct {
+	inode  uint64
+	offset int64
+	// Lines dated before or at after are skipped, logs are in order so only lines up to the first later one are parsed
+	after     time.Time
+	parseDate func(string) (time.Time, error)
+	handle    logHandler
+}
+
+// line sends a line read from the log including its newline
+func (p *logPosition) line(line string) {
+	p.offset += int64(len(line))
+	line = strings.TrimRight(line, "\r\n")
+
+	if !p.after.IsZero() {
+		t, err := p.parseDate(line)
+		if err != nil || !t.After(p.after) {
+			return
+		}
+		p.after = time.Time{}
+	}
+
+	p.handle(line, p.inode, p.offset)
+}
+
+// seekDate binary searches an uncompressed log for the first line after p.after
+// so the lines before it don't have to be parsed one by one
+func (p *logPosition) seekDate(path string) {
+	if p.after.IsZero() || p.offset != 0 {
+		return
+	}
+
+	// BinarySearchFileByDate can't handle empty files
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return
+	}
+
+	start := time.Now()
+	offset, err := datarithms.BinarySearchFileByDate(path, p.after, p.parseDate)
+	if err != nil {
+		logging.Warn("Failed to search", path, "by date", err)
+		return
+	}
+	logging.Info("Found the offset in", path, "in", time.Since(start))
+
+	// The line found may still be before p.after if no line is later, so p.after is kept
+	p.offset = offset
+}
+
+// readRotatedLog sends every line of a rotated log after the position to its handler
+func (p *logPosition) readRotatedLog(log rotatedLog) error {
+	f, err := os.Open(log.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	p.inode = fileInode(info)
+
+	var r io.Reader = f
+	if log.gz {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+
+		// Compressed files can't seek
+		_, err = io.CopyN(io.Discard, gz, p.offset)
+		if err != nil {
+			return err
+		}
+	} else {
+		p.seekDate(log.path)
+		_, err = f.Seek(p.offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			p.line(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// FollowLog sends each line of logFile after cursor to handle and then follows the file across rotations
+// Lines that were written to rotated copies of logFile after the cursor, for example while we weren't running, are sent first
+// A zero cursor starts at the beginning of logFile
+func FollowLog(logFile string, cursor LogCursor, parseDate func(string) (time.Time, error), handle logHandler) {
+	logs := rotatedLogs(logFile)
+	live := len(logs) - 1
+
+	// Find the file the cursor points into. If the file was truncated the cursor is no use
+	start := -1
+	for i, log := range logs {
+		info, err := os.Stat(log.path)
+		if err != nil || cursor.Inode == 0 || fileInode(info) != cursor.Inode {
+			continue
+		}
+		if log.gz || info.Size() >= cursor.Offset {
+			start = i
+		}
+	}
+
+	// The cursor only has an offset inside the file it was found in, otherwise the copies are searched by date
+	p := &logPosition{parseDate: parseDate, handle: handle}
+	if start >= 0 {
+		p.offset = cursor.Offset
+	} else if !cursor.Time.IsZero() {
+		p.after = cursor.Time
+		start = 0
+	} else {
+		start = live
+	}
+
+	for i := start; i < live; i++ {
+		// Copies last written before the cursor can be skipped without reading them
+		info, err := os.Stat(logs[i].path)
+		if err == nil && !p.after.IsZero() && info.ModTime().Before(p.after) {
+			continue
+		}
+
+		logging.Info("Catching up on", logs[i].path)
+		err = p.readRotatedLog(logs[i])
+		if err != nil {
+			logging.Warn("Failed to read rotated log", logs[i].path, err)
+		}
+		p.offset = 0
+	}
+
+	p.follow(logFile)
+}
+
+// follow sends the lines of the live log to the handler as they are written, like `tail -F`
+// When the log is rotated the rest of the old file is read before moving on to the new one
+func (p *logPosition) follow(logFile string) {
+	f, err := os.Open(logFile)
+	if err != nil {
+		logging.Error("Failed to start following", logFile, err)
+		return
+	}
+	defer func() { f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		logging.Error("Failed to start following", logFile, err)
+		return
+	}
+	p.inode = fileInode(info)
+
+	p.seekDate(logFile)
+	_, err = f.Seek(p.offset, io.SeekStart)
+	if err != nil {
+		logging.Error("Failed to start following", logFile, err)
+		return
+	}
+	logging.Success("Following", logFile)
+
+	r := bufio.NewReader(f)
+	// A line that is still being written is kept until its newline arrives
+	partial := ""
+	rotated := false
+	for {
+		line, err := r.ReadString('\n')
+		if err == nil {
+			p.line(partial + line)
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			logging.Error("Failed to read", logFile, err)
+			return
+		}
+		partial += line
+
+		time.Sleep(logPollInterval)
+
+		info, err := os.Stat(logFile)
+		switch {
+		case err != nil:
+			// The log was moved away and hasn't been recreated yet
+		case fileInode(info) != p.inode:
+			// Give nginx a poll interval to reopen its logs before moving on to the new file
+			if !rotated {
+				rotated = true
+				continue
+			}
+
+			next, err := os.Open(logFile)
+			if err != nil {
+				continue
+			}
+			info, err = next.Stat()
+			if err != nil {
+				next.Close()
+				continue
+			}
+
+			// Read what nginx wrote to the old file while we waited, it won't be written to anymore so its last line is complete
+			for {
+				line, err := r.ReadString('\n')
+				partial += line
+				if err != nil {
+					if err != io.EOF {
+						logging.Warn("Failed to finish reading", logFile, err)
+					}
+					break
+				}
+				p.line(partial)
+				partial = ""
+			}
+			if partial != "" {
+				p.line(partial)
+			}
+			f.Close()
+
+			logging.Info(logFile, "was rotated")
+			f = next
+			r.Reset(f)
+			p.inode = fileInode(info)
+			p.offset = 0
+			partial = ""
+			rotated = false
+		case info.Size() < p.offset+int64(len(partial)):
+			// The log was truncated in place, by logrotate's copytruncate for example
+			logging.Info(logFile, "was truncated")
+			_, err = f.Seek(0, io.SeekStart)
+			if err != nil {
+				logging.Error("Failed to read", logFile, err)
+				return
+			}
+			r.Reset(f)
+			p.offset = 0
+			partial = ""
+		}
+	}
+}
+
+// copyLogCursors creates a copy of cursors
+func copyLogCursors(cursors map[string]LogCursor) map[string]LogCursor {
+	c := make(map[string]LogCursor, len(cursors))
+	for log, cursor := range cursors {
+		c[log] = cursor
+	}
+	return c
+}
@@ -28,8 +28,24 @@ var (
 	influxToken string
 	// INFLUX_READ_ONLY
 	influxReadOnly bool
+	// INFLUX_URL
+	influxURL string
+	// INFLUX_ORG
+	influxOrg string
+	// INFLUX_BUCKET
+	influxBucket string
+	// INFLUX_PUBLIC_BUCKET
+	influxPublicBucket string
+	// INFLUX_CA_CERT
+	influxCACert string
+	// INFLUX_INSECURE_SKIP_VERIFY
+	influxInsecureSkipVerify bool
+	// STATS_FILE
+	statsFile string
 	// NGINX_TAIL
 	nginxTail string
+	// NGINX_LOG_FORMAT
+	nginxLogFormat string
 	// RSYNCD_TAIL
 	rsyncdTail string
 	// SCHEDULER_PAUSED
@@ -38,6 +54,10 @@ var (
 	syncDryRun bool
 	// RSYNC_LOGS
 	syncLogs string
+	// SYNC_HISTORY
+	syncHistory string
+	// SYNC_TIMEOUT
+	syncTimeout time.Duration
 	// WEB_SERVER_CACHE
 	webServerCache bool
 	// HOOK_URL
@@ -46,10 +66,22 @@ var (
 	pingID string
 	// PULL_TOKEN
 	pullToken string
+	// SYNC_AUDIT_LOG
+	syncAuditLog string
+	// PROMETHEUS_METRICS
+	prometheusMetrics bool
+	// TRANSMISSION_URL
+	transmissionURL string
+	// TRANSMISSION_USER
+	transmissionUser string
+	// TRANSMISSION_PASSWORD
+	transmissionPassword string
 	// TORRENT_DIR
 	torrentDir string
 	// DOWNLOAD_DIR
 	downloadDir string
+	// TORRENT_VERIFY_PIECES
+	torrentVerifyPieces bool
 )
 
 func init() {
@@ -66,18 +98,34 @@ func init() {
 	maxmindLicenseKey = os.Getenv("MAXMIND_LICENSE_KEY")
 	influxToken = os.Getenv("INFLUX_TOKEN")
 	influxReadOnly = os.Getenv("INFLUX_READ_ONLY") == "true"
+	influxURL = getenvDefault("INFLUX_URL", "https://mirror.clarkson.edu:8086")
+	influxOrg = getenvDefault("INFLUX_ORG", "COSI")
+	influxBucket = getenvDefault("INFLUX_BUCKET", "stats")
+	influxPublicBucket = getenvDefault("INFLUX_PUBLIC_BUCKET", "public")
+	influxCACert = os.Getenv("INFLUX_CA_CERT")
+	influxInsecureSkipVerify = os.Getenv("INFLUX_INSECURE_SKIP_VERIFY") == "true"
+	statsFile = os.Getenv("STATS_FILE")
 	nginxTail = os.Getenv("NGINX_TAIL")
+	nginxLogFormat = os.Getenv("NGINX_LOG_FORMAT")
 	rsyncdTail = os.Getenv("RSYNCD_TAIL")
 	schedulerPaused = os.Getenv("SCHEDULER_PAUSED") == "true"
 	syncDryRun = os.Getenv("RSYNC_DRY_RUN") == "true" || os.Getenv("SYNC_DRY_RUN") == "true"
 	syncLogs = os.Getenv("RSYNC_LOGS")
+	syncHistory = os.Getenv("SYNC_HISTORY")
+	syncTimeoutStr := os.Getenv("SYNC_TIMEOUT")
 	webServerCache = os.Getenv("WEB_SERVER_CACHE") == "true"
 	hookURL = os.Getenv("HOOK_URL")
 	pingID = os.Getenv("PING_ID")
 	pullToken = os.Getenv("PULL_TOKEN")
+	syncAuditLog = os.Getenv("SYNC_AUDIT_LOG")
+	prometheusMetrics = os.Getenv("PROMETHEUS_METRICS") == "true"
 	admGroupStr := os.Getenv("ADM_GROUP")
+	transmissionURL = getenvDefault("TRANSMISSION_URL", "http://localhost:9091/transmission/rpc")
+	transmissionUser = getenvDefault("TRANSMISSION_USER", "transmission")
+	transmissionPassword = os.Getenv("TRANSMISSION_PASSWORD")
 	torrentDir = os.Getenv("TORRENT_DIR")
 	downloadDir = os.Getenv("DOWNLOAD_DIR")
+	torrentVerifyPieces = os.Getenv("TORRENT_VERIFY_PIECES") == "true"
 
 	if admGroupStr != "" {
 		admGroup, err = strconv.Atoi(admGroupStr)
@@ -102,13 +150,41 @@ func init() {
 		}
 	}
 
+	if nginxLogFormat != "" {
+		format, err := NewNginxLogFormat(nginxLogFormat)
+		if err != nil {
+			logging.Error("environment variable NGINX_LOG_FORMAT", err, "using the default format")
+		} else {
+			nginxFormat = format
+		}
+	}
+
+	if syncTimeoutStr != "" {
+		syncTimeout, err = time.ParseDuration(syncTimeoutStr)
+		if err != nil {
+			logging.Warn("environment variable SYNC_TIMEOUT", err)
+		}
+	}
+
 	// Check if the environment variables are set
 	if maxmindLicenseKey == "" {
 		logging.Warn("No MAXMIND_LICENSE_KEY environment variable found. GeoIP database will not be updated")
 	}
 
 	if influxToken == "" {
-		logging.Warn("No INFLUX_TOKEN environment variable found. InfluxDB will not be used")
+		if statsFile != "" {
+			logging.Warn("No INFLUX_TOKEN environment variable found. Statistics will be saved to", statsFile)
+		} else {
+			logging.Warn("No INFLUX_TOKEN or STATS_FILE environment variable found. Statistics will be lost on restart")
+		}
+	}
+
+	if influxToken != "" && influxInsecureSkipVerify {
+		logging.Warn("INFLUX_INSECURE_SKIP_VERIFY is set, the InfluxDB certificate will not be verified")
+	}
+
+	if prometheusMetrics {
+		logging.Info("PROMETHEUS_METRICS is set, metrics will be served at /metrics")
 	}
 
 	if influxReadOnly {
@@ -135,6 +211,14 @@ func init() {
 		logging.Warn("No RSYNC_LOGS environment variable found. Persisent logs are not being saved")
 	}
 
+	if syncTimeout <= 0 {
+		logging.Warn("SYNC_TIMEOUT is not set. Projects without a timeout can sync forever")
+	}
+
+	if syncHistory == "" {
+		logging.Warn("No SYNC_HISTORY environment variable found. Sync history will be lost on restart")
+	}
+
 	if !webServerCache {
 		logging.Warn("WEB_SERVER_CACHE is disabled. Expensive websever requests will not be cached")
 	}
@@ -147,6 +231,10 @@ func init() {
 		logging.Warn("PULL_TOKEN is not set so there is no master pull token")
 	}
 
+	if syncAuditLog == "" {
+		logging.Warn("No SYNC_AUDIT_LOG environment variable found. Uses of access tokens are only logged")
+	}
+
 	// check that the system is linux
 	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
 		logging.Warn("Torrent syncing is only support on *nix systems including the `find` command")
@@ -161,9 +249,80 @@ func init() {
 	}
 }
 
-func loadConfig() *ConfigFile {
-	config := ParseConfig("configs/mirrors.json", "configs/mirrors.schema.json", "configs/tokens.txt")
-	return &config
+// getenvDefault returns the environment variable or fallback if it is empty
+func getenvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Locations of the config files
+const (
+	configFile = "configs/mirrors.json"
+	schemaFile = "configs/mirrors.schema.json"
+	tokensFile = "configs/tokens.txt"
+)
+
+func loadConfig() (*ConfigFile, error) {
+	config, err := ParseConfig(configFile, schemaFile, tokensFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, warning := range config.Warnings() {
+		logging.Warn(warning)
+	}
+	return config, nil
+}
+
+// mintTokenCommand prints a new access token and the line to add to tokens.txt for the mint-token subcommand
+func mintTokenCommand(args []string) int {
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Println("usage: Mirror mint-token project name [expires " + tokenExpiryFormat + "]")
+		return 2
+	}
+
+	expires := ""
+	if len(args) == 3 {
+		expires = args[2]
+	}
+
+	token, line, err := mintToken(args[0], args[1], expires)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	fmt.Println("Give this token to", args[1]+", it is not stored anywhere:")
+	fmt.Println(token)
+	fmt.Println()
+	fmt.Println("Add this line to", tokensFile+":")
+	fmt.Println(line)
+	return 0
+}
+
+// checkConfig validates a config file for the check-config subcommand and returns the exit code
+func checkConfig(file string) int {
+	config, err := ParseConfig(file, schemaFile, tokensFile)
+	if err != nil {
+		fmt.Println(file, "is not valid")
+		if problems, ok := err.(ConfigError); ok {
+			for _, problem := range problems {
+				fmt.Println("-", problem)
+			}
+		} else {
+			fmt.Println("-", err)
+		}
+		return 1
+	}
+
+	warnings := config.Warnings()
+	for _, warning := range warnings {
+		fmt.Println("warning:", warning)
+	}
+	fmt.Println(file, "is valid,", len(config.Mirrors), "projects,", len(warnings), "warnings")
+	return 0
 }
 
 var restartCount int
@@ -193,11 +352,29 @@ func main() {
 		fmt.Println("This program should no longer be run as root")
 	}
 
+	// `Mirror check-config [file]` validates the config without starting anything
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		file := configFile
+		if len(os.Args) > 2 {
+			file = os.Args[2]
+		}
+		os.Exit(checkConfig(file))
+	}
+
+	// `Mirror mint-token project name [expires]` creates an access token
+	if len(os.Args) > 1 && os.Args[1] == "mint-token" {
+		os.Exit(mintTokenCommand(os.Args[2:]))
+	}
+
 	// Setup logging
 	logging.Setup(hookURL, pingID)
 
 	// Parse the config file
-	config := loadConfig()
+	config, err := loadConfig()
+	if err != nil {
+		logging.Error("Failed to load the config.", err)
+		os.Exit(1)
+	}
 
 	// Update the rsyncd.conf file based on the config file
 	createRsyncdConfig(config)
@@ -207,7 +384,6 @@ func main() {
 	map_entries := make(chan *NginxLogEntry, 100)
 
 	// GeoIP lookup
-	var err error
 	if maxmindLicenseKey != "" {
 		geoipHandler, err = geoip.NewGeoIPHandler(maxmindLicenseKey)
 		if err != nil {
@@ -215,45 +391,65 @@ func main() {
 		}
 	}
 
-	// Connect to the database
-	if influxToken == "" {
+	// User agent classification rules
+	classifier, err := LoadAgentClassifier("configs/agents.json")
+	if err != nil {
+		logging.Error("Failed to load configs/agents.json, user agents will not be classified", err)
+	} else {
+		agentClassifier = classifier
+	}
+
+	transmission = NewTransmissionClient(transmissionURL, transmissionUser, transmissionPassword)
+
+	// Statistics are saved to influxdb if we have a token, otherwise to a local file or only kept in memory
+	var store StatsStore
+	if influxToken != "" {
+		err = SetupInfluxClients(influxToken)
+		if err != nil {
+			logging.Error("Failed to setup InfluxDB clients", err)
+		} else {
+			logging.Success("Connected to InfluxDB")
+			store = NewInfluxStatsStore(reader, writer)
+		}
+	}
+	if store == nil && statsFile != "" {
+		store = NewFileStatsStore(statsFile)
+	}
+	if store == nil {
+		store = NewMemoryStatsStore()
+	}
+
+	cursors, err := InitStatistics(store, config.Mirrors, config.Networks)
+	if err != nil {
+		logging.Error("Failed to initialize statistics. Not tracking statistics", err)
+
 		if nginxTail != "" {
-			// zero date
-			var zero time.Time
-			go TailNginxLogFile(nginxTail, zero, map_entries)
+			// Without statistics there is nothing to catch up on, the map only shows new requests
+			go TailNginxLogFile(nginxTail, LogCursor{Time: time.Now()}, map_entries)
 		} else {
 			// if nginxTail is empty we attempt to read a local access log for testing
 			go ReadNginxLogFile("access.log", map_entries)
 		}
 	} else {
-		SetupInfluxClients(influxToken)
-		logging.Success("Connected to InfluxDB")
+		logging.Success("Initialized statistics")
 
 		// Stats handling
 		nginxEntries := make(chan *NginxLogEntry, 100)
 		rsyncdEntries := make(chan *RsyncdLogEntry, 100)
+		go HandleStatistics(nginxEntries, rsyncdEntries)
 
-		lastUpdated, err := InitStatistics(config.Mirrors)
-
-		if err != nil {
-			logging.Error("Failed to initialize statistics. Not tracking statistics", err)
+		if nginxTail != "" {
+			go TailNginxLogFile(nginxTail, cursors["nginx"], nginxEntries, map_entries)
 		} else {
-			logging.Success("Initialized statistics")
-			go HandleStatistics(nginxEntries, rsyncdEntries)
-
-			if nginxTail != "" {
-				go TailNginxLogFile(nginxTail, lastUpdated, nginxEntries, map_entries)
-			} else {
-				// if nginxTail is empty we attempt to read a local file for testing
-				go ReadNginxLogFile("access.log", nginxEntries, map_entries)
-			}
+			// if nginxTail is empty we attempt to read a local file for testing
+			go ReadNginxLogFile("access.log", nginxEntries, map_entries)
+		}
 
-			if rsyncdTail != "" {
-				go TailRSyncdLogFile(rsyncdTail, lastUpdated, rsyncdEntries)
-			} else {
-				// if rsyncdTail is empty we attempt to read a local file for testing
-				go ReadRsyncdLogFile("rsyncd.log", rsyncdEntries)
-			}
+		if rsyncdTail != "" {
+			go TailRSyncdLogFile(rsyncdTail, cursors["rsyncd"], rsyncdEntries)
+		} else {
+			// if rsyncdTail is empty we attempt to read a local file for testing
+			go ReadRsyncdLogFile("rsyncd.log", rsyncdEntries)
 		}
 	}
 
@@ -263,24 +459,49 @@ func main() {
 
 	var manual chan string
 
+	// torrent scheduler
+	var torrentManual chan struct{}
+	reloadTorrents := func() {}
+	if torrentDir != "" && downloadDir != "" {
+		torrentManual = make(chan struct{})
+		torrentStop := make(chan struct{})
+		go HandleTorrents(config, torrentDir, downloadDir, torrentManual, torrentStop, true)
+
+		reloadTorrents = func() {
+			// stop the torrent scheduler and restart it with the new config
+			torrentStop <- struct{}{}
+			<-torrentStop
+			go HandleTorrents(config, torrentDir, downloadDir, torrentManual, torrentStop, false)
+			logging.Info("Restarted torrent scheduler")
+		}
+	}
+
 	if schedulerPaused {
 		go func() {
 			for {
 				<-sighup
 				logging.Info("Received SIGHUP")
 
-				config = loadConfig()
+				newConfig, err := loadConfig()
+				if err != nil {
+					logging.ErrorToDiscord("Failed to reload the config, keeping the old one.", err)
+					continue
+				}
+				config = newConfig
 				logging.Info("Reloaded config")
 
 				WebserverLoadConfig(config)
 				logging.Info("Reloaded projects page")
+
+				reloadTorrents()
 			}
 		}()
 	} else {
 		// rsync scheduler
 		stop := make(chan struct{})
 		manual = make(chan string)
-		rsyncStatus := make(RSYNCStatus)
+		rsyncStatus := NewRSYNCStatus(config, nil)
+		WebserverLoadSyncStatus(rsyncStatus)
 		go handleSyncs(config, rsyncStatus, manual, stop)
 
 		go func() {
@@ -288,7 +509,12 @@ func main() {
 				<-sighup
 				logging.Info("Received SIGHUP")
 
-				config = loadConfig()
+				newConfig, err := loadConfig()
+				if err != nil {
+					logging.ErrorToDiscord("Failed to reload the config, keeping the old one.", err)
+					continue
+				}
+				config = newConfig
 				logging.Info("Reloaded config")
 
 				WebserverLoadConfig(config)
@@ -298,22 +524,19 @@ func main() {
 				stop <- struct{}{}
 				<-stop
 
-				// restart the rsync scheduler
-				rsyncStatus := make(RSYNCStatus)
+				// restart the rsync scheduler keeping the history of projects that still exist
+				rsyncStatus = NewRSYNCStatus(config, rsyncStatus)
+				WebserverLoadSyncStatus(rsyncStatus)
 				go handleSyncs(config, rsyncStatus, manual, stop)
+
+				reloadTorrents()
 			}
 		}()
 	}
 
-	// torrent scheduler
-	// TODO: handle reload
-	if torrentDir != "" && downloadDir != "" {
-		go HandleTorrents(config, torrentDir, downloadDir)
-	}
-
 	// Webserver
 	WebserverLoadConfig(config)
-	go HandleWebserver(manual, map_entries)
+	go HandleWebserver(manual, torrentManual, map_entries)
 
 	go HandleCheckIn()
 
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/COSI-Lab/logging"
+)
+
+// The /metrics endpoint exports our statistics in the prometheus text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// metricsWriter writes metric families, each family's HELP and TYPE is only written once
+type metricsWriter struct {
+	w       *bytes.Buffer
+	written map[string]bool
+}
+
+// labelEscaper escapes label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes a single sample, labels are alternating names and values
+func (m *metricsWriter) sample(name, kind, help string, value interface{}, labels ...string) {
+	if !m.written[name] {
+		m.written[name] = true
+		fmt.Fprintf(m.w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(m.w, "# TYPE %s %s\n", name, kind)
+	}
+
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.w.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, " %v\n", value)
+}
+
+// distroMetrics writes the counters of a DistroStatistics under the given prefix
+func (m *metricsWriter) distroMetrics(prefix, description string, stats DistroStatistics) {
+	distros := make([]string, 0, len(stats))
+	for distro := range stats {
+		distros = append(distros, distro)
+	}
+	sort.Strings(distros)
+
+	for _, distro := range distros {
+		m.sample(prefix+"_bytes_sent_total", "counter", "Bytes sent to "+description, stats[distro].BytesSent, "distro", distro)
+	}
+	for _, distro := range distros {
+		m.sample(prefix+"_bytes_recv_total", "counter", "Bytes received from "+description, stats[distro].BytesRecv, "distro", distro)
+	}
+	for _, distro := range distros {
+		m.sample(prefix+"_requests_total", "counter", "Requests from "+description, stats[distro].Requests, "distro", distro)
+	}
+}
+
+// networkMetrics writes the traffic of each network group, every sample of a metric has to be written together
+func (m *metricsWriter) networkMetrics(stats NetworkStatistics) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name, help string
+		value      func(*NetStat) int64
+	}{
+		{"mirror_network_bytes_sent_total", "Bytes sent to HTTP clients in a configured network", func(stat *NetStat) int64 { return stat.BytesSent }},
+		{"mirror_network_bytes_recv_total", "Bytes received from HTTP clients in a configured network", func(stat *NetStat) int64 { return stat.BytesRecv }},
+		{"mirror_network_requests_total", "Requests from HTTP clients in a configured network", func(stat *NetStat) int64 { return stat.Requests }},
+	}
+	for _, metric := range metrics {
+		for _, name := range names {
+			distros := make([]string, 0, len(stats[name]))
+			for distro := range stats[name] {
+				distros = append(distros, distro)
+			}
+			sort.Strings(distros)
+
+			for _, distro := range distros {
+				m.sample(metric.name, "counter", metric.help, metric.value(stats[name][distro]), "network", name, "distro", distro)
+			}
+		}
+	}
+}
+
+// statusMetrics writes the responses of each distro by status class
+func (m *metricsWriter) statusMetrics(stats StatusStatistics) {
+	distros := make([]string, 0, len(stats))
+	for distro := range stats {
+		distros = append(distros, distro)
+	}
+	sort.Strings(distros)
+
+	const help = "HTTP responses by status class"
+	for _, distro := range distros {
+		classes := stats[distro]
+		m.sample("mirror_nginx_responses_total", "counter", help, classes.Status2xx, "distro", distro, "class", "2xx")
+		m.sample("mirror_nginx_responses_total", "counter", help, classes.Status3xx, "distro", distro, "class", "3xx")
+		m.sample("mirror_nginx_responses_total", "counter", help, classes.Status4xx, "distro", distro, "class", "4xx")
+		m.sample("mirror_nginx_responses_total", "counter", help, classes.Status5xx, "distro", distro, "class", "5xx")
+	}
+}
+
+// agentMetrics writes the requests of each distro by user agent class
+func (m *metricsWriter) agentMetrics(stats AgentStatistics) {
+	distros := make([]string, 0, len(stats))
+	for distro := range stats {
+		distros = append(distros, distro)
+	}
+	sort.Strings(distros)
+
+	for _, distro := range distros {
+		classes := make([]string, 0, len(stats[distro]))
+		for class := range stats[distro] {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+
+		for _, class := range classes {
+			m.sample("mirror_nginx_agent_requests_total", "counter", "HTTP requests by user agent class", stats[distro][class], "distro", distro, "class", class)
+		}
+	}
+}
+
+// syncMetrics writes the result of the most recent syncs of every project
+func (m *metricsWriter) syncMetrics(status RSYNCStatus) {
+	shorts := make([]string, 0, len(status))
+	for short := range status {
+		shorts = append(shorts, short)
+	}
+	sort.Strings(shorts)
+
+	// Every sample of a metric has to be written together
+	metrics := []struct {
+		name, help string
+		value      func(Status) interface{}
+	}{
+		{"mirror_sync_last_duration_seconds", "Duration of the most recent sync stage", func(last Status) interface{} { return last.Duration().Seconds() }},
+		{"mirror_sync_last_exit_code", "Exit code of the most recent sync stage", func(last Status) interface{} { return last.ExitCode }},
+		{"mirror_sync_last_end_timestamp_seconds", "Unix time the most recent sync stage finished", func(last Status) interface{} { return last.EndTime }},
+	}
+	for _, metric := range metrics {
+		for _, short := range shorts {
+			history := status.History(short)
+			if len(history) == 0 {
+				continue
+			}
+			m.sample(metric.name, "gauge", metric.help, metric.value(history[len(history)-1]), "project", short)
+		}
+	}
+
+	for _, short := range shorts {
+		if success, ok := status.LastSuccess(short); ok {
+			m.sample("mirror_sync_last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync stage", success.EndTime, "project", short)
+		}
+	}
+
+	for _, short := range shorts {
+		running := 0
+		if isSyncing(short) {
+			running = 1
+		}
+		m.sample("mirror_sync_running", "gauge", "1 if the project is currently syncing", running, "project", short)
+	}
+}
+
+// The /metrics endpoint
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// Everything is written to a buffer first so we aren't holding any locks while sending
+	m := &metricsWriter{
+		w:       &bytes.Buffer{},
+		written: make(map[string]bool),
+	}
+
+	statistics.RLock()
+	if statistics.nginx != nil {
+		m.distroMetrics("mirror_nginx", "HTTP clients", statistics.nginx)
+		m.networkMetrics(statistics.networks)
+		m.statusMetrics(statistics.statuses)
+		m.agentMetrics(statistics.agents)
+
+		m.distroMetrics("mirror_rsyncd", "rsync clients", statistics.rsyncd)
+
+		m.sample("mirror_transmission_uploaded_bytes_total", "counter", "Bytes uploaded by transmission", statistics.transmission.Uploaded)
+		m.sample("mirror_transmission_downloaded_bytes_total", "counter", "Bytes downloaded by transmission", statistics.transmission.Downloaded)
+		m.sample("mirror_transmission_torrents", "gauge", "Torrents loaded in transmission", statistics.transmission.Torrents)
+		m.sample("mirror_transmission_ratio", "gauge", "Upload ratio reported by transmission", statistics.transmission.Ratio)
+
+		shorts := make([]string, 0, len(statistics.transmission.Projects))
+		for short := range statistics.transmission.Projects {
+			shorts = append(shorts, short)
+		}
+		sort.Strings(shorts)
+		for _, short := range shorts {
+			m.sample("mirror_transmission_project_uploaded_bytes", "gauge", "Bytes uploaded by the seeded torrents of a project", statistics.transmission.Projects[short], "distro", short)
+		}
+	}
+	statistics.RUnlock()
+
+	m.sample("mirror_log_lines_skipped_total", "counter", "Log lines that could not be parsed", nginxSkippedLines.Load(), "log", "nginx")
+	m.sample("mirror_log_lines_skipped_total", "counter", "Log lines that could not be parsed", rsyncdSkippedLines.Load(), "log", "rsyncd")
+
+	dataLock.RLock()
+	status := syncStatus
+	dataLock.RUnlock()
+	m.syncMetrics(status)
+
+	_, err := m.w.WriteTo(w)
+	if err != nil {
+		logging.Warn("handleMetrics;", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// NetworkGroup is a named set of address ranges, such as a campus or a partner ISP
+// Requests from each group are counted separately for every project and saved to a measurement named after the group
+type NetworkGroup struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	CIDRs       []string `json:"cidrs"`
+
+	nets []*net.IPNet
+}
+
+// reservedNetworkNames are the measurements used by other statistics, a group can't share their name
+var reservedNetworkNames = map[string]bool{
+	"nginx": true, "rsync": true, "rsyncd": true, "transmission": true, "transmission_projects": true, "status": true, "agents": true,
+	"not_found": true, "geo": true, "visitors": true, "log_cursor": true, "other": true, "total": true,
+}
+
+// parseNetworkGroups parses the CIDRs of every group and checks that the names are usable
+func parseNetworkGroups(groups []*NetworkGroup) error {
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		if reservedNetworkNames[group.Name] {
+			return fmt.Errorf("network %q: the name is reserved", group.Name)
+		}
+		if seen[group.Name] {
+			return fmt.Errorf("network %q is listed twice", group.Name)
+		}
+		seen[group.Name] = true
+
+		group.nets = make([]*net.IPNet, 0, len(group.CIDRs))
+		for _, cidr := range group.CIDRs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("network %q: %w", group.Name, err)
+			}
+			group.nets = append(group.nets, ipnet)
+		}
+	}
+	return nil
+}
+
+// Contains returns true if ip is in any of the group's ranges
+func (group *NetworkGroup) Contains(ip net.IP) bool {
+	for _, ipnet := range group.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkStatistics is the traffic of each network group by distro
+type NetworkStatistics map[string]DistroStatistics
+
+// mergeNetworkStatistics creates counters for every group starting from the saved values
+func mergeNetworkStatistics(projects map[string]*Project, groups []*NetworkGroup, saved NetworkStatistics) NetworkStatistics {
+	stats := make(NetworkStatistics, len(groups))
+	for _, group := range groups {
+		stats[group.Name] = mergeDistroStatistics(projects, saved[group.Name])
+	}
+	return stats
+}
+
+// copyNetworkStatistics creates a deep copy of stats
+func copyNetworkStatistics(stats NetworkStatistics) NetworkStatistics {
+	c := make(NetworkStatistics, len(stats))
+	for name, distros := range stats {
+		c[name] = copyDistroStatistics(distros)
+	}
+	return c
+}
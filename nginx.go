@@ -3,21 +3,16 @@ package main
 import (
 	"bufio"
 	"errors"
-	"io"
 	"net"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/COSI-Lab/datarithms"
-	"github.com/COSI-Lab/logging"
 	"github.com/IncSW/geoip2"
-	"github.com/nxadm/tail"
 )
 
-// It is critical that NGINX uses the following log format:
+// By default NGINX should use the following log format, other formats can be set with NGINX_LOG_FORMAT (see nginx_format.go)
 /*
  * log_format config '"$time_local" "$remote_addr" "$request" "$status" "$body_bytes_sent" "$request_length" "$http_user_agent"';
  * access_log /var/log/nginx/access.log config;
@@ -36,10 +31,15 @@ type NginxLogEntry struct {
 	BytesSent int64
 	BytesRecv int64
 	Agent     string
+	// The following are only set if the log format includes them
+	RequestTime time.Duration
+	Referer     string
+	SSLProtocol string
+	Host        string
+	// Cursor is the position in the log just after this entry
+	Cursor LogCursor
 }
 
-var reQuotes = regexp.MustCompile(`"(.*?)"`)
-
 // ReadNginxLogFile is a testing function that simulates tailing a log file by reading it line by line with some delay between lines
 func ReadNginxLogFile(logFile string, channels ...chan *NginxLogEntry) (err error) {
 	for {
@@ -65,82 +65,47 @@ func ReadNginxLogFile(logFile string, channels ...chan *NginxLogEntry) (err erro
 	}
 }
 
-// TailNginxLogFile tails a log file and sends the parsed log entries to the specified channels
-func TailNginxLogFile(logFile string, lastUpdated time.Time, channels ...chan *NginxLogEntry) {
-	// Find the offset of the line where the date is past lastUpdated
-	start := time.Now()
-	offset, err := datarithms.BinarySearchFileByDate(logFile, lastUpdated, parseNginxDate)
-	if err != nil {
-		logging.Error(err)
-		return
-	}
-	logging.Info("Found nginx log offset in", time.Since(start))
-
-	// Tail the log file `tail -F` starting at the offset
-	seek := tail.SeekInfo{
-		Offset: offset,
-		Whence: io.SeekStart,
-	}
-	tail, err := tail.TailFile(logFile, tail.Config{Follow: true, ReOpen: true, MustExist: true, Location: &seek})
-	if err != nil {
-		logging.Error("Failed to start tailing `nginx.log`:", err)
-		return
-	}
-
-	logging.Success("Tailing nginx log file")
-
-	// Parse each line as we receive it
-	for line := range tail.Lines {
-		entry, err := parseNginxLine(line.Text)
+// TailNginxLogFile follows a log file starting after cursor and sends the parsed log entries to the specified channels
+func TailNginxLogFile(logFile string, cursor LogCursor, channels ...chan *NginxLogEntry) {
+	FollowLog(logFile, cursor, parseNginxDate, func(line string, inode uint64, offset int64) {
+		entry, err := parseNginxLine(line)
+		if err != nil {
+			nginxSkippedLines.Add(1)
+			return
+		}
+		entry.Cursor = LogCursor{Inode: inode, Offset: offset, Time: entry.Time}
 
-		if err == nil {
-			// Send a pointer to the entry down each channel
-			for ch := range channels {
-				channels[ch] <- entry
-			}
+		// Send a pointer to the entry down each channel
+		for ch := range channels {
+			channels[ch] <- entry
 		}
-	}
+	})
 }
 
 // parseNginxDate parses a single line of the nginx log file and returns the time.Time of the line
 func parseNginxDate(line string) (time.Time, error) {
-	tm, err := time.Parse("\"02/Jan/2006:15:04:05 -0700\"", reQuotes.FindString(line))
-	if err != nil {
-		return time.Time{}, err
-	}
-	return tm, nil
+	return nginxFormat.Date(line)
 }
 
 // parseNginxLine parses a single line of the nginx log file
-// It's critical the log file uses the correct format found at the top of this file
-// If the log file is not in the correct format or if some other part of the parsing fails
+// If the line does not match nginxFormat or if some other part of the parsing fails
 // this function will return an error
 func parseNginxLine(line string) (*NginxLogEntry, error) {
-	// "$time_local" "$remote_addr" "$request" "$status" "$body_bytes_sent" "$request_length" "$http_user_agent";
-	quoteList := reQuotes.FindAllString(line, -1)
-
-	if len(quoteList) != 7 {
-		return nil, errors.New("invalid number of parameters in log entry")
-	}
-
-	// Trim quotation marks
-	for i := 0; i < len(quoteList); i++ {
-		quoteList[i] = quoteList[i][1 : len(quoteList[i])-1]
+	fields, err := nginxFormat.Fields(line)
+	if err != nil {
+		return nil, err
 	}
 
 	var entry NginxLogEntry
-	var err error
 
 	// Time
-	t := "02/Jan/2006:15:04:05 -0700"
-	tm, err := time.Parse(t, quoteList[0])
+	entry.Time, err = nginxFieldsTime(fields)
 	if err != nil {
 		return nil, err
 	}
-	entry.Time = tm
 
 	// IPv4 or IPv6 address
-	entry.IP = net.ParseIP(quoteList[1])
+	entry.IP = net.ParseIP(fields["remote_addr"])
 	if entry.IP == nil {
 		return nil, errors.New("failed to parse ip")
 	}
@@ -158,17 +123,22 @@ func parseNginxLine(line string) (*NginxLogEntry, error) {
 	}
 
 	// Method url http version
-	split := strings.Split(quoteList[2], " ")
-	if len(split) != 3 {
-		// this should never fail
-		return nil, errors.New("invalid number of strings in request")
+	if request, ok := fields["request"]; ok {
+		split := strings.Split(request, " ")
+		if len(split) != 3 {
+			return nil, errors.New("invalid number of strings in request")
+		}
+		entry.Method = split[0]
+		entry.Url = split[1]
+		entry.Version = split[2]
+	} else {
+		entry.Method = fields["request_method"]
+		entry.Url = fields["request_uri"]
+		entry.Version = fields["server_protocol"]
 	}
-	entry.Method = split[0]
-	entry.Url = split[1]
-	entry.Version = split[2]
 
 	// Distro is the top level of the URL path
-	split = strings.Split(entry.Url, "/")
+	split := strings.Split(entry.Url, "/")
 
 	if len(split) >= 2 {
 		entry.Distro = split[1]
@@ -177,30 +147,56 @@ func parseNginxLine(line string) (*NginxLogEntry, error) {
 	}
 
 	// HTTP response status
-	status, err := strconv.Atoi(quoteList[3])
+	status, err := strconv.Atoi(fields["status"])
 	if err != nil {
-		// this should never fail
 		return nil, errors.New("could not parse http response status")
 	}
 	entry.Status = status
 
 	// Bytes sent int64
-	bytesSent, err := strconv.ParseInt(quoteList[4], 10, 64)
+	sent, ok := fields["body_bytes_sent"]
+	if !ok {
+		sent = fields["bytes_sent"]
+	}
+	bytesSent, err := strconv.ParseInt(sent, 10, 64)
 	if err != nil {
-		// this should never fail
 		return nil, errors.New("could not parse bytes_sent")
 	}
 	entry.BytesSent = bytesSent
 
 	// Bytes received
-	bytesRecv, err := strconv.ParseInt(quoteList[5], 10, 64)
-	if err != nil {
-		return nil, errors.New("could not parse bytes_recv")
+	if recv, ok := fields["request_length"]; ok {
+		bytesRecv, err := strconv.ParseInt(recv, 10, 64)
+		if err != nil {
+			return nil, errors.New("could not parse bytes_recv")
+		}
+		entry.BytesRecv = bytesRecv
 	}
-	entry.BytesRecv = bytesRecv
 
 	// User agent
-	entry.Agent = quoteList[6]
+	entry.Agent = fields["http_user_agent"]
+
+	// Seconds with millisecond resolution
+	if requestTime, ok := fields["request_time"]; ok {
+		seconds, err := strconv.ParseFloat(requestTime, 64)
+		if err != nil {
+			return nil, errors.New("could not parse request_time")
+		}
+		entry.RequestTime = time.Duration(seconds * float64(time.Second))
+	}
+
+	// nginx logs missing values as "-"
+	entry.Referer = nginxOptional(fields["http_referer"])
+	entry.SSLProtocol = nginxOptional(fields["ssl_protocol"])
+	entry.Host = nginxOptional(fields["host"])
 
 	return &entry, nil
 }
+
+// nginxOptional returns "" for values nginx logged as missing
+func nginxOptional(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
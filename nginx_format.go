@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The nginx access log format is set with NGINX_LOG_FORMAT. It is either the same template given to
+// nginx's log_format directive or "json" for logs written with `log_format name escape=json`
+// where each key is the name of the variable without the $
+/*
+ * log_format json escape=json '{"time_local":"$time_local","remote_addr":"$remote_addr","request":"$request",'
+ *     '"status":$status,"body_bytes_sent":$body_bytes_sent,"request_length":$request_length,'
+ *     '"http_user_agent":"$http_user_agent","request_time":$request_time,"http_referer":"$http_referer",'
+ *     '"ssl_protocol":"$ssl_protocol","host":"$host"}';
+ */
+
+// defaultNginxLogFormat is the format we have always used
+const defaultNginxLogFormat = `"$time_local" "$remote_addr" "$request" "$status" "$body_bytes_sent" "$request_length" "$http_user_agent"`
+
+// NginxLogFormat splits lines of the access log into nginx variables
+type NginxLogFormat interface {
+	// Fields returns the value of each variable in the line keyed by its name without the $
+	Fields(line string) (map[string]string, error)
+	// Date returns only the time of the line, it is used to binary search the log file
+	Date(line string) (time.Time, error)
+}
+
+// nginxFormat is the format of NGINX_TAIL
+var nginxFormat NginxLogFormat = mustNginxLogFormat(defaultNginxLogFormat)
+
+// NewNginxLogFormat compiles a log_format template or returns the json format
+func NewNginxLogFormat(format string) (NginxLogFormat, error) {
+	if format == "json" {
+		return jsonNginxLogFormat{}, nil
+	}
+	return compileNginxLogFormat(format)
+}
+
+func mustNginxLogFormat(format string) NginxLogFormat {
+	f, err := NewNginxLogFormat(format)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Variables are written $name or ${name}
+var reNginxVariable = regexp.MustCompile(`\$(?:([a-z0-9_]+)|\{([a-z0-9_]+)\})`)
+
+// templateNginxLogFormat matches lines with a regular expression built from the log_format template
+type templateNginxLogFormat struct {
+	re *regexp.Regexp
+	// dateRe only matches up to the time variable so Date doesn't have to match the whole line
+	dateRe *regexp.Regexp
+	// the time variable used by the template
+	timeVar string
+}
+
+// compileNginxLogFormat turns every variable into a capture group and every other character into a literal
+func compileNginxLogFormat(format string) (*templateNginxLogFormat, error) {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+
+	f := &templateNginxLogFormat{}
+	seen := make(map[string]bool)
+	var datePattern string
+	var timeEnd int
+
+	last := 0
+	for _, match := range reNginxVariable.FindAllStringSubmatchIndex(format, -1) {
+		var name string
+		if match[2] != -1 {
+			name = format[match[2]:match[3]]
+		} else {
+			name = format[match[4]:match[5]]
+		}
+
+		pattern.WriteString(regexp.QuoteMeta(format[last:match[0]]))
+		last = match[1]
+
+		if seen[name] {
+			// Go regular expressions can't reuse a group name so repeats are matched but ignored
+			pattern.WriteString("(?:.*?)")
+			continue
+		}
+		seen[name] = true
+
+		pattern.WriteString("(?P<" + name + ">.*?)")
+
+		if f.timeVar == "" && nginxTimeVariables[name] {
+			f.timeVar = name
+			datePattern = pattern.String()
+			timeEnd = match[1]
+		}
+	}
+	pattern.WriteString(regexp.QuoteMeta(format[last:]))
+	pattern.WriteString("$")
+
+	var err error
+	f.re, err = regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if f.timeVar == "" {
+		return nil, errors.New("log format has no $time_local, $time_iso8601 or $msec")
+	}
+	// The time is only known to end where the next literal starts, so include the following literal if there is one
+	rest := format[timeEnd:]
+	if next := reNginxVariable.FindStringIndex(rest); next != nil {
+		rest = rest[:next[0]]
+	}
+	if rest == "" {
+		datePattern += "$"
+	} else {
+		datePattern += regexp.QuoteMeta(rest)
+	}
+	f.dateRe, err = regexp.Compile(datePattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if !seen["remote_addr"] {
+		return nil, errors.New("log format has no $remote_addr")
+	}
+	if !seen["request"] && !(seen["request_method"] && seen["request_uri"]) {
+		return nil, errors.New("log format has no $request or $request_method and $request_uri")
+	}
+	if !seen["status"] {
+		return nil, errors.New("log format has no $status")
+	}
+	if !seen["body_bytes_sent"] && !seen["bytes_sent"] {
+		return nil, errors.New("log format has no $body_bytes_sent or $bytes_sent")
+	}
+
+	return f, nil
+}
+
+func (f *templateNginxLogFormat) Fields(line string) (map[string]string, error) {
+	match := f.re.FindStringSubmatch(line)
+	if match == nil {
+		return nil, errors.New("line does not match the log format")
+	}
+
+	fields := make(map[string]string, len(match))
+	for i, name := range f.re.SubexpNames() {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+	return fields, nil
+}
+
+func (f *templateNginxLogFormat) Date(line string) (time.Time, error) {
+	match := f.dateRe.FindStringSubmatch(line)
+	if match == nil {
+		return time.Time{}, errors.New("line does not match the log format")
+	}
+	return parseNginxTime(f.timeVar, match[f.dateRe.SubexpIndex(f.timeVar)])
+}
+
+// jsonNginxLogFormat reads lines that are JSON objects
+type jsonNginxLogFormat struct{}
+
+func (jsonNginxLogFormat) Fields(line string) (map[string]string, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	err := decoder.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(object))
+	for name, value := range object {
+		switch value := value.(type) {
+		case string:
+			fields[name] = value
+		case json.Number:
+			fields[name] = value.String()
+		case nil:
+			fields[name] = ""
+		default:
+			fields[name] = fmt.Sprint(value)
+		}
+	}
+	return fields, nil
+}
+
+func (f jsonNginxLogFormat) Date(line string) (time.Time, error) {
+	fields, err := f.Fields(line)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return nginxFieldsTime(fields)
+}
+
+// The variables that can be used as the time of a line
+var nginxTimeVariables = map[string]bool{
+	"time_local":   true,
+	"time_iso8601": true,
+	"msec":         true,
+}
+
+// parseNginxTime parses the value of one of nginxTimeVariables
+func parseNginxTime(name, value string) (time.Time, error) {
+	switch name {
+	case "time_local":
+		return time.Parse("02/Jan/2006:15:04:05 -0700", value)
+	case "time_iso8601":
+		return time.Parse(time.RFC3339, value)
+	case "msec":
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.UnixMilli(int64(seconds * 1000)), nil
+	}
+	return time.Time{}, fmt.Errorf("$%s is not a time", name)
+}
+
+// nginxFieldsTime finds the time in the parsed fields of a line
+func nginxFieldsTime(fields map[string]string) (time.Time, error) {
+	for _, name := range []string{"time_local", "time_iso8601", "msec"} {
+		if value, ok := fields[name]; ok {
+			return parseNginxTime(name, value)
+		}
+	}
+	return time.Time{}, errors.New("log entry has no time")
+}
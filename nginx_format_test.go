@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNginxLogFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		line   string
+		want   map[string]string
+		date   time.Time
+	}{
+		{
+			name:   "default",
+			format: defaultNginxLogFormat,
+			line:   `"02/Jan/2024:10:20:30 -0500" "128.153.145.19" "GET /archlinux/iso/latest/archlinux-x86_64.iso HTTP/1.1" "206" "1048576" "312" "Wget/1.21.4"`,
+			want: map[string]string{
+				"time_local":      "02/Jan/2024:10:20:30 -0500",
+				"remote_addr":     "128.153.145.19",
+				"request":         "GET /archlinux/iso/latest/archlinux-x86_64.iso HTTP/1.1",
+				"status":          "206",
+				"body_bytes_sent": "1048576",
+				"request_length":  "312",
+				"http_user_agent": "Wget/1.21.4",
+			},
+			date: time.Date(2024, 1, 2, 15, 20, 30, 0, time.UTC),
+		},
+		{
+			// ${var} is the same as $var, the repeated $remote_addr only has to match
+			name:   "custom",
+			format: `${remote_addr} - [$time_iso8601] "$request_method ${request_uri}" $status $body_bytes_sent "$http_user_agent" via $remote_addr`,
+			line:   `2001:db8::1 - [2024-01-02T10:20:30+00:00] "GET /debian/dists/bookworm/InRelease" 304 0 "Debian APT-HTTP/1.3 (2.6.1)" via 2001:db8::1`,
+			want: map[string]string{
+				"remote_addr":     "2001:db8::1",
+				"time_iso8601":    "2024-01-02T10:20:30+00:00",
+				"request_method":  "GET",
+				"request_uri":     "/debian/dists/bookworm/InRelease",
+				"status":          "304",
+				"body_bytes_sent": "0",
+				"http_user_agent": "Debian APT-HTTP/1.3 (2.6.1)",
+			},
+			date: time.Date(2024, 1, 2, 10, 20, 30, 0, time.UTC),
+		},
+		{
+			name:   "msec",
+			format: `$msec $remote_addr "$request" $status $bytes_sent`,
+			line:   `1704190830.123 192.0.2.7 "GET / HTTP/2.0" 200 5120`,
+			want: map[string]string{
+				"msec":        "1704190830.123",
+				"remote_addr": "192.0.2.7",
+				"request":     "GET / HTTP/2.0",
+				"status":      "200",
+				"bytes_sent":  "5120",
+			},
+			date: time.Date(2024, 1, 2, 10, 20, 30, 123000000, time.UTC),
+		},
+		{
+			// Numbers are unquoted in escape=json logs
+			name:   "json",
+			format: "json",
+			line:   `{"time_local":"02/Jan/2024:10:20:30 +0000","remote_addr":"198.51.100.4","request":"GET /fedora/ HTTP/1.1","status":200,"body_bytes_sent":18446,"request_time":0.005,"http_referer":"","ssl_protocol":null}`,
+			want: map[string]string{
+				"time_local":      "02/Jan/2024:10:20:30 +0000",
+				"remote_addr":     "198.51.100.4",
+				"request":         "GET /fedora/ HTTP/1.1",
+				"status":          "200",
+				"body_bytes_sent": "18446",
+				"request_time":    "0.005",
+				"http_referer":    "",
+				"ssl_protocol":    "",
+			},
+			date: time.Date(2024, 1, 2, 10, 20, 30, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		format, err := NewNginxLogFormat(test.format)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		fields, err := format.Fields(test.line)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for name, value := range test.want {
+			if fields[name] != value {
+				t.Errorf("%s: $%s is %q, want %q", test.name, name, fields[name], value)
+			}
+		}
+
+		date, err := format.Date(test.line)
+		if err != nil || !date.Equal(test.date) {
+			t.Errorf("%s: date is %v, %v, want %v", test.name, date, err, test.date)
+		}
+	}
+}
+
+func TestNginxLogFormatDatePrefix(t *testing.T) {
+	format, err := NewNginxLogFormat(defaultNginxLogFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the start of the line up to the time has to match for the binary search
+	line := `"02/Jan/2024:10:20:30 +0000" "a line cut off by a crash`
+	_, err = format.Fields(line)
+	if err == nil {
+		t.Error("an incomplete line was parsed")
+	}
+	date, err := format.Date(line)
+	if err != nil || !date.Equal(time.Date(2024, 1, 2, 10, 20, 30, 0, time.UTC)) {
+		t.Errorf("date is %v, %v", date, err)
+	}
+
+	_, err = format.Date(`not a log line`)
+	if err == nil {
+		t.Error("a line without a date was dated")
+	}
+}
+
+func TestNginxLogFormatInvalid(t *testing.T) {
+	tests := []struct {
+		format string
+		err    string
+	}{
+		{`$remote_addr "$request" $status $body_bytes_sent`, "$time_local"},
+		{`$time_local "$request" $status $body_bytes_sent`, "$remote_addr"},
+		{`$time_local $remote_addr $status $body_bytes_sent`, "$request"},
+		{`$time_local $remote_addr $request_method $status $body_bytes_sent`, "$request"},
+		{`$time_local $remote_addr "$request" $body_bytes_sent`, "$status"},
+		{`$time_local $remote_addr "$request" $status`, "$body_bytes_sent"},
+	}
+
+	for _, test := range tests {
+		_, err := NewNginxLogFormat(test.format)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error about %s", test.format, err, test.err)
+		}
+	}
+}
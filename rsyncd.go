@@ -2,22 +2,44 @@ package main
 
 import (
 	"bufio"
-	"fmt"
-	"io"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/COSI-Lab/datarithms"
-	"github.com/COSI-Lab/logging"
-	"github.com/nxadm/tail"
 )
 
+// The rsync daemon logs each connection over several lines that share its pid
+/*
+ * 2022/04/20 20:00:00 [1234] connect from host.example.com (192.0.2.1)
+ * 2022/04/20 20:00:00 [1234] rsync on fedora/linux/releases/ from host.example.com (192.0.2.1)
+ * 2022/04/20 20:00:05 [1234] 2022/04/20 20:00:05 send 192.0.2.1 fedora linux/releases/README 1024
+ * 2022/04/20 20:00:10 [1234] sent 2048 bytes  received 512 bytes  total size 4096
+ */
+// The per file lines come from the `log format = %t %o %a %m %f %b` in the rsyncd.conf we generate
+
+// RsyncdLogEntry is a finished rsync connection
 type RsyncdLogEntry struct {
-	time time.Time
-	sent int64
-	recv int64
+	time   time.Time
+	pid    int
+	module string
+	sent   int64
+	recv   int64
+	// position in the log just after this entry
+	cursor LogCursor
+}
+
+// rsyncdSessionTimeout is how long a connection is remembered without its summary line
+// rsync doesn't log one when a connection fails or the client goes away
+const rsyncdSessionTimeout = 24 * time.Hour
+
+// RsyncdParser correlates the lines of each connection by pid
+type RsyncdParser struct {
+	sessions  map[int]*RsyncdLogEntry
+	lastPrune time.Time
+}
+
+func NewRsyncdParser() *RsyncdParser {
+	return &RsyncdParser{sessions: make(map[int]*RsyncdLogEntry)}
 }
 
 func ReadRsyncdLogFile(logFile string, ch chan *RsyncdLogEntry) (err error) {
@@ -27,10 +49,11 @@ func ReadRsyncdLogFile(logFile string, ch chan *RsyncdLogEntry) (err error) {
 			return err
 		}
 
+		parser := NewRsyncdParser()
 		scanner := bufio.NewScanner(f)
 		for scanner.Scan() {
-			entry, err := parseRsyncdLine(scanner.Text())
-			if err == nil {
+			entry, err := parser.Parse(scanner.Text())
+			if err == nil && entry != nil {
 				// Send a pointer to the entry down the channel
 				ch <- entry
 			}
@@ -42,38 +65,23 @@ func ReadRsyncdLogFile(logFile string, ch chan *RsyncdLogEntry) (err error) {
 	}
 }
 
-func TailRSyncdLogFile(logFile string, lastUpdated time.Time, ch chan *RsyncdLogEntry) {
-	// Find the offset of the line where the date is past lastUpdated
-	start := time.Now()
-	offset, err := datarithms.BinarySearchFileByDate(logFile, lastUpdated, parseRsyncdDate)
-	if err != nil {
-		logging.Error(err)
-		return
-	}
-	logging.Info("Found rsyncd log offset in", time.Since(start))
-
-	// Tail the log file `tail -F` starting at the offset
-	seek := tail.SeekInfo{
-		Offset: offset,
-		Whence: io.SeekStart,
-	}
-	tail, err := tail.TailFile(logFile, tail.Config{Follow: true, ReOpen: true, MustExist: true, Location: &seek})
-	if err != nil {
-		logging.Error("Failed to start tailing `rsyncd.log`:", err)
-		return
-	}
-
-	logging.Success("Tailing rsyncd log file")
-
-	// Parse each line as we receive it
-	for line := range tail.Lines {
-		entry, err := parseRsyncdLine(line.Text)
-
-		if err == nil {
-			// Send a pointer to the entry down each channel
-			ch <- entry
+// TailRSyncdLogFile follows a log file starting after cursor and sends the finished connections to ch
+func TailRSyncdLogFile(logFile string, cursor LogCursor, ch chan *RsyncdLogEntry) {
+	parser := NewRsyncdParser()
+	FollowLog(logFile, cursor, parseRsyncdDate, func(line string, inode uint64, offset int64) {
+		entry, err := parser.Parse(line)
+		if err != nil {
+			rsyncdSkippedLines.Add(1)
+			return
 		}
-	}
+		if entry == nil {
+			return
+		}
+		entry.cursor = LogCursor{Inode: inode, Offset: offset, Time: entry.time}
+
+		// Send a pointer to the entry down the channel
+		ch <- entry
+	})
 }
 
 type ParseLineError struct{}
@@ -104,45 +112,93 @@ func parseRsyncdDate(line string) (time.Time, error) {
 	return t, nil
 }
 
-func parseRsyncdLine(line string) (*RsyncdLogEntry, error) {
-	// 2022/04/20 20:00:10 [pid] sent XXX bytes  received XXX bytes  total size XXX
-
-	// Split the line over whitespace
-	parts := strings.Split(line, " ")
+// splitRsyncdLine splits a line into its date, pid and message
+func splitRsyncdLine(line string) (t time.Time, pid int, message string, err error) {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) != 4 {
+		return t, pid, message, ParseLineError{}
+	}
 
-	// the line we want has 14 parts
-	if len(parts) != 14 {
-		return nil, ParseLineError{}
+	t, err = time.Parse("2006/01/02 15:04:05", parts[0]+" "+parts[1])
+	if err != nil {
+		return t, pid, message, err
 	}
 
-	// the 4th part is "sent"
-	if parts[3] != "sent" {
-		return nil, ParseLineError{}
+	if !strings.HasPrefix(parts[2], "[") || !strings.HasSuffix(parts[2], "]") {
+		return t, pid, message, ParseLineError{}
+	}
+	pid, err = strconv.Atoi(parts[2][1 : len(parts[2])-1])
+	if err != nil {
+		return t, pid, message, ParseLineError{}
 	}
 
-	// The 1st part is the date
-	dt := parts[0]
-	// 2nd part is the time
-	tm := parts[1]
+	return t, pid, parts[3], nil
+}
 
-	// make the time.Time object
-	t, err := time.Parse("2006/01/02 15:04:05", dt+" "+tm)
+// Parse reads a line of the log and returns the connection it finished, if any
+// Lines that aren't from rsyncd return an error
+func (p *RsyncdParser) Parse(line string) (*RsyncdLogEntry, error) {
+	t, pid, message, err := splitRsyncdLine(line)
 	if err != nil {
 		return nil, err
 	}
+	p.prune(t)
 
-	// part 5 is the number of bytes sent
-	sent, err := strconv.ParseInt(parts[4], 10, 64)
-	if err != nil {
-		fmt.Println(err)
-		return nil, ParseLineError{}
+	fields := strings.Fields(message)
+	if len(fields) == 0 {
+		return nil, nil
 	}
 
-	recv, err := strconv.ParseInt(parts[8], 10, 64)
-	if err != nil {
-		fmt.Println(err)
-		return nil, ParseLineError{}
+	// pids are reused so a new connection always starts a new session
+	session := p.sessions[pid]
+	if session == nil || strings.HasPrefix(message, "connect from ") {
+		session = &RsyncdLogEntry{pid: pid}
+		p.sessions[pid] = session
+	}
+	session.time = t
+
+	switch {
+	case strings.HasPrefix(message, "rsync on ") || strings.HasPrefix(message, "rsync to "):
+		// rsync on MODULE/PATH from HOST (ADDR)
+		if len(fields) >= 3 {
+			session.module, _, _ = strings.Cut(fields[2], "/")
+		}
+	case strings.HasPrefix(message, "rsync allowed access on module "):
+		// rsync allowed access on module MODULE from HOST (ADDR)
+		if len(fields) >= 6 {
+			session.module = fields[5]
+		}
+	case len(fields) >= 7 && (fields[2] == "send" || fields[2] == "recv") && session.module == "":
+		// DATE TIME send ADDR MODULE FILE BYTES, these fill in connections that started before we did
+		session.module = fields[4]
+	case len(fields) >= 5 && fields[0] == "sent" && fields[2] == "bytes" && fields[3] == "received":
+		// sent XXX bytes  received XXX bytes  total size XXX
+		delete(p.sessions, pid)
+
+		session.sent, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, ParseLineError{}
+		}
+		session.recv, err = strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, ParseLineError{}
+		}
+		return session, nil
 	}
 
-	return &RsyncdLogEntry{sent: sent, recv: recv, time: t}, nil
+	return nil, nil
+}
+
+// prune forgets connections that haven't logged anything for rsyncdSessionTimeout
+func (p *RsyncdParser) prune(now time.Time) {
+	if now.Sub(p.lastPrune) < time.Hour {
+		return
+	}
+	p.lastPrune = now
+
+	for pid, session := range p.sessions {
+		if now.Sub(session.time) > rsyncdSessionTimeout {
+			delete(p.sessions, pid)
+		}
+	}
 }
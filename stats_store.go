@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/COSI-Lab/logging"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// StatsSnapshot is a copy of `statistics` that can be saved without holding its lock
+type StatsSnapshot struct {
+	Time         time.Time              `json:"time"`
+	Nginx        DistroStatistics       `json:"nginx"`
+	Networks     NetworkStatistics      `json:"networks"`
+	Transmission TransmissionStatistics `json:"transmission"`
+	Rsyncd       DistroStatistics       `json:"rsync"`
+	Statuses     StatusStatistics       `json:"statuses"`
+	// The tracked 404 paths of each project
+	NotFound map[string][]TopKEntry `json:"notFound"`
+	Agents   AgentStatistics        `json:"agents"`
+	// Daily geographic statistics and popular downloads
+	Geo       GeoStatistics      `json:"geo"`
+	Downloads DownloadStatistics `json:"downloads"`
+	// Where counting stopped in each log
+	Cursors map[string]LogCursor `json:"cursors"`
+}
+
+// StatsStore is where the statistics counters are saved so they survive restarts
+type StatsStore interface {
+	// Load returns the most recently saved statistics
+	// Distros and networks that were never saved are missing from the snapshot
+	Load(projects map[string]*Project, networks []*NetworkGroup) (StatsSnapshot, error)
+	// Save records the current statistics
+	Save(snapshot StatsSnapshot) error
+}
+
+// copyDistroStatistics creates a deep copy of stats
+func copyDistroStatistics(stats DistroStatistics) DistroStatistics {
+	c := make(DistroStatistics, len(stats))
+	for distro, stat := range stats {
+		statCopy := *stat
+		c[distro] = &statCopy
+	}
+	return c
+}
+
+// copyStatusStatistics creates a deep copy of stats
+func copyStatusStatistics(stats StatusStatistics) StatusStatistics {
+	c := make(StatusStatistics, len(stats))
+	for distro, classes := range stats {
+		classesCopy := *classes
+		c[distro] = &classesCopy
+	}
+	return c
+}
+
+// InfluxStatsStore saves statistics as points in INFLUX_BUCKET
+type InfluxStatsStore struct {
+	reader api.QueryAPI
+	writer api.WriteAPI
+	// registers are the date and visitor registers last written for each distro, they are only written again once they change
+	registers map[string]string
+}
+
+// NewInfluxStatsStore creates a store from the clients created by SetupInfluxClients
+// writer is nil if INFLUX_READ_ONLY is set
+func NewInfluxStatsStore(reader api.QueryAPI, writer api.WriteAPI) *InfluxStatsStore {
+	return &InfluxStatsStore{reader: reader, writer: writer, registers: make(map[string]string)}
+}
+
+func (s *InfluxStatsStore) Load(projects map[string]*Project, networks []*NetworkGroup) (snapshot StatsSnapshot, err error) {
+	snapshot.Time, snapshot.Nginx, err = QueryDistroStatistics(s.reader, projects, "nginx")
+	if err != nil {
+		return snapshot, err
+	}
+
+	// Each network has a measurement named after it
+	snapshot.Networks = make(NetworkStatistics, len(networks))
+	for _, group := range networks {
+		_, snapshot.Networks[group.Name], err = QueryDistroStatistics(s.reader, projects, group.Name)
+		if err != nil {
+			return snapshot, err
+		}
+	}
+
+	_, snapshot.Rsyncd, err = QueryDistroStatistics(s.reader, projects, "rsync")
+	if err != nil {
+		return snapshot, err
+	}
+
+	// Before rsync traffic was counted per module only the total was saved
+	if snapshot.Rsyncd["total"].Requests == 0 {
+		total, err := QueryRsyncdStatistics(s.reader)
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Rsyncd["total"] = &total
+	}
+
+	snapshot.Statuses, err = QueryStatusStatistics(s.reader)
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.Agents, err = QueryAgentStatistics(s.reader)
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.NotFound, err = QueryNotFoundStatistics(s.reader)
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.Geo, err = QueryGeoStatistics(s.reader)
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.Downloads, err = QueryDownloadStatistics(s.reader)
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.Cursors, err = QueryLogCursors(s.reader)
+	if err != nil {
+		return snapshot, err
+	}
+
+	return snapshot, nil
+}
+
+func (s *InfluxStatsStore) Save(snapshot StatsSnapshot) error {
+	if s.writer == nil {
+		logging.Info("INFLUX_READ_ONLY is set, not sending data to influx")
+		return nil
+	}
+
+	t := snapshot.Time
+	for short, stat := range snapshot.Nginx {
+		p := influxdb2.NewPoint("nginx",
+			map[string]string{"distro": short},
+			map[string]interface{}{
+				"bytes_sent": stat.BytesSent,
+				"bytes_recv": stat.BytesRecv,
+				"requests":   stat.Requests,
+			}, t)
+		s.writer.WritePoint(p)
+	}
+	for name, network := range snapshot.Networks {
+		for short, stat := range network {
+			p := influxdb2.NewPoint(name,
+				map[string]string{"distro": short},
+				map[string]interface{}{
+					"bytes_sent": stat.BytesSent,
+					"bytes_recv": stat.BytesRecv,
+					"requests":   stat.Requests,
+				}, t)
+			s.writer.WritePoint(p)
+		}
+	}
+	p := influxdb2.NewPoint("transmission", map[string]string{}, map[string]interface{}{
+		"downloaded": snapshot.Transmission.Downloaded,
+		"uploaded":   snapshot.Transmission.Uploaded,
+		"torrents":   snapshot.Transmission.Torrents,
+		"ratio":      snapshot.Transmission.Ratio,
+	}, t)
+	s.writer.WritePoint(p)
+	for short, uploaded := range snapshot.Transmission.Projects {
+		p := influxdb2.NewPoint("transmission_projects",
+			map[string]string{"distro": short},
+			map[string]interface{}{
+				"uploaded": uploaded,
+			}, t)
+		s.writer.WritePoint(p)
+	}
+	for short, stat := range snapshot.Rsyncd {
+		p := influxdb2.NewPoint("rsync",
+			map[string]string{"distro": short},
+			map[string]interface{}{
+				"bytes_sent": stat.BytesSent,
+				"bytes_recv": stat.BytesRecv,
+				"requests":   stat.Requests,
+			}, t)
+		s.writer.WritePoint(p)
+	}
+	// The untagged total is still written for existing dashboards
+	if total, ok := snapshot.Rsyncd["total"]; ok {
+		p = influxdb2.NewPoint("rsyncd", map[string]string{}, map[string]interface{}{
+			"bytes_sent": total.BytesSent,
+			"bytes_recv": total.BytesRecv,
+			"requests":   total.Requests,
+		}, t)
+		s.writer.WritePoint(p)
+	}
+	for short, classes := range snapshot.Statuses {
+		p := influxdb2.NewPoint("status",
+			map[string]string{"distro": short},
+			map[string]interface{}{
+				"2xx": classes.Status2xx,
+				"3xx": classes.Status3xx,
+				"4xx": classes.Status4xx,
+				"5xx": classes.Status5xx,
+			}, t)
+		s.writer.WritePoint(p)
+	}
+	for short, classes := range snapshot.Agents {
+		for class, requests := range classes {
+			p := influxdb2.NewPoint("agents",
+				map[string]string{"distro": short, "class": class},
+				map[string]interface{}{
+					"requests": requests,
+				}, t)
+			s.writer.WritePoint(p)
+		}
+	}
+	for log, cursor := range snapshot.Cursors {
+		p := influxdb2.NewPoint("log_cursor",
+			map[string]string{"log": log},
+			map[string]interface{}{
+				"inode":  int64(cursor.Inode),
+				"offset": cursor.Offset,
+				"time":   cursor.Time.UnixNano(),
+			}, t)
+		s.writer.WritePoint(p)
+	}
+	// Only the top paths are sent. Paths come from whoever sends the request so they are
+	// a field, the rank tag keeps the number of series at notFoundShown for each project
+	for short, entries := range snapshot.NotFound {
+		if len(entries) > notFoundShown {
+			entries = entries[:notFoundShown]
+		}
+		for i, entry := range entries {
+			p := influxdb2.NewPoint("not_found",
+				map[string]string{"distro": short, "rank": strconv.Itoa(i + 1)},
+				map[string]interface{}{
+					"path":     entry.Key,
+					"requests": entry.Count,
+				}, t)
+			s.writer.WritePoint(p)
+		}
+	}
+
+	// Today's most popular downloads, like the 404 paths the rank is the tag and the path a field
+	for short, downloads := range snapshot.Downloads {
+		if len(downloads.Days) == 0 {
+			continue
+		}
+		day := downloads.Days[len(downloads.Days)-1]
+		if day.Date != t.UTC().Format("2006-01-02") {
+			continue
+		}
+		for kind, topk := range map[string]*TopK{"requests": day.Requests, "bytes": day.Bytes} {
+			for i, entry := range topk.Top(downloadsSaved) {
+				p := influxdb2.NewPoint("downloads",
+					map[string]string{"distro": short, "kind": kind, "rank": strconv.Itoa(i + 1)},
+					map[string]interface{}{
+						"path":  entry.Key,
+						"count": entry.Count,
+						"error": entry.Error,
+					}, t)
+				s.writer.WritePoint(p)
+			}
+		}
+	}
+
+	// Today's geographic statistics, influxdb keeps the history and the last point of each day is loaded back
+	for short, geo := range snapshot.Geo {
+		day := geo.today()
+		if day == nil {
+			continue
+		}
+		for country, stat := range day.Countries {
+			p := influxdb2.NewPoint("geo",
+				map[string]string{"distro": short, "country": country},
+				map[string]interface{}{
+					"bytes_sent": stat.BytesSent,
+					"bytes_recv": stat.BytesRecv,
+					"requests":   stat.Requests,
+				}, t)
+			s.writer.WritePoint(p)
+		}
+		for continent, stat := range day.Continents {
+			p := influxdb2.NewPoint("geo_continent",
+				map[string]string{"distro": short, "continent": continent},
+				map[string]interface{}{
+					"bytes_sent": stat.BytesSent,
+					"bytes_recv": stat.BytesRecv,
+					"requests":   stat.Requests,
+				}, t)
+			s.writer.WritePoint(p)
+		}
+
+		// The registers are a few KiB so they are skipped while nobody new visits
+		fields := map[string]interface{}{
+			"unique": day.Visitors.Count(),
+		}
+		registers := base64.StdEncoding.EncodeToString(day.Visitors.Registers)
+		if s.registers[short] != day.Date+registers {
+			fields["registers"] = registers
+			s.registers[short] = day.Date + registers
+		}
+		p := influxdb2.NewPoint("visitors", map[string]string{"distro": short}, fields, t)
+		s.writer.WritePoint(p)
+	}
+
+	return nil
+}
+
+// FileStatsStore saves the latest snapshot as a JSON file
+// Only the latest counters are kept, there is no history like in influxdb
+type FileStatsStore struct {
+	path string
+}
+
+func NewFileStatsStore(path string) *FileStatsStore {
+	return &FileStatsStore{path: path}
+}
+
+// Load returns an empty snapshot if the file doesn't exist yet
+func (s *FileStatsStore) Load(projects map[string]*Project, networks []*NetworkGroup) (snapshot StatsSnapshot, err error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+// Save atomically replaces the file so a crash never leaves a partial snapshot behind
+func (s *FileStatsStore) Save(snapshot StatsSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// MemoryStatsStore keeps the latest snapshot in memory
+// It is used when there is nowhere to save statistics, and by tests
+type MemoryStatsStore struct {
+	lock     sync.Mutex
+	snapshot StatsSnapshot
+}
+
+func NewMemoryStatsStore() *MemoryStatsStore {
+	return &MemoryStatsStore{}
+}
+
+func (s *MemoryStatsStore) Load(projects map[string]*Project, networks []*NetworkGroup) (StatsSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snapshot := s.snapshot
+	snapshot.Nginx = copyDistroStatistics(s.snapshot.Nginx)
+	snapshot.Networks = copyNetworkStatistics(s.snapshot.Networks)
+	snapshot.Rsyncd = copyDistroStatistics(s.snapshot.Rsyncd)
+	snapshot.Transmission = copyTransmissionStatistics(s.snapshot.Transmission)
+	snapshot.Statuses = copyStatusStatistics(s.snapshot.Statuses)
+	snapshot.Geo = copyGeoStatistics(s.snapshot.Geo)
+	snapshot.Agents = copyAgentStatistics(s.snapshot.Agents)
+	snapshot.Downloads = copyDownloadStatistics(s.snapshot.Downloads)
+	snapshot.Cursors = copyLogCursors(s.snapshot.Cursors)
+	return snapshot, nil
+}
+
+func (s *MemoryStatsStore) Save(snapshot StatsSnapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.snapshot = snapshot
+	s.snapshot.Nginx = copyDistroStatistics(snapshot.Nginx)
+	s.snapshot.Networks = copyNetworkStatistics(snapshot.Networks)
+	s.snapshot.Rsyncd = copyDistroStatistics(snapshot.Rsyncd)
+	s.snapshot.Transmission = copyTransmissionStatistics(snapshot.Transmission)
+	s.snapshot.Statuses = copyStatusStatistics(snapshot.Statuses)
+	s.snapshot.Geo = copyGeoStatistics(snapshot.Geo)
+	s.snapshot.Agents = copyAgentStatistics(snapshot.Agents)
+	s.snapshot.Downloads = copyDownloadStatistics(snapshot.Downloads)
+	s.snapshot.Cursors = copyLogCursors(snapshot.Cursors)
+	return nil
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/COSI-Lab/datarithms"
 	"github.com/COSI-Lab/logging"
@@ -16,13 +21,23 @@ type Status struct {
 	StartTime int64 `json:"startTime"`
 	EndTime   int64 `json:"endTime"`
 	ExitCode  int   `json:"exitCode"`
+	// The sync ran past its timeout and was stopped
+	TimedOut bool `json:"timedOut,omitempty"`
+	// The sync was stopped by /sync/{project}/cancel
+	Cancelled bool `json:"cancelled,omitempty"`
 }
 type RSYNCStatus map[string]*datarithms.CircularQueue[Status]
 
+// syncGracePeriod is how long a sync has to exit after SIGTERM before it is sent SIGKILL
+const syncGracePeriod = time.Minute
+
 var rsyncErrorCodes map[int]string
 var syncLock sync.Mutex
 var syncLocks = make(map[string]bool)
 
+// syncCancels stops the running sync of a project, protected by syncLock
+var syncCancels = make(map[string]context.CancelFunc)
+
 func init() {
 	rsyncErrorCodes = make(map[int]string)
 	rsyncErrorCodes[0] = "Success"
@@ -57,9 +72,21 @@ func init() {
 			logging.Success("opened RSYNC_LOGS directory", syncLogs)
 		}
 	}
+
+	// Create the sync history directory
+	if syncHistory != "" {
+		err := os.MkdirAll(syncHistory, 0755)
+
+		if err != nil {
+			logging.Warn("failed to create SYNC_HISTORY directory", syncHistory, err, "not saving sync history")
+			syncHistory = ""
+		} else {
+			logging.Success("opened SYNC_HISTORY directory", syncHistory)
+		}
+	}
 }
 
-func rsync(project *Project, options string) ([]byte, *os.ProcessState) {
+func rsync(ctx context.Context, project *Project, options string, output *SyncOutput) *os.ProcessState {
 	// split up the options TODO maybe precompute this?
 	// actually in hindsight this whole thing can be precomputed
 	args := strings.Split(options, " ")
@@ -78,7 +105,7 @@ func rsync(project *Project, options string) ([]byte, *os.ProcessState) {
 	}
 	args = append(args, project.Rsync.Dest)
 
-	command := exec.Command("rsync", args...)
+	command := commandContext(ctx, "rsync", args...)
 
 	// Add the password environment variable if needed
 	if project.Rsync.Password != "" {
@@ -86,40 +113,179 @@ func rsync(project *Project, options string) ([]byte, *os.ProcessState) {
 	}
 
 	logging.Info(command)
+	output.Printf("%s", command)
 
-	output, _ := command.CombinedOutput()
+	command.Stdout = output
+	command.Stderr = output
+	err := command.Run()
+	if err != nil && command.ProcessState == nil {
+		output.Printf("could not start rsync: %s", err)
+	}
+	output.Close()
 
-	return output, command.ProcessState
+	return command.ProcessState
 }
 
-func appendToLogFile(short string, data []byte) {
-	// Get month
-	month := fmt.Sprintf("%02d", time.Now().UTC().Month())
+// syncCommand is a command started by a sync
+type syncCommand struct {
+	*exec.Cmd
+	// kill sends SIGKILL to the process group once the grace period after SIGTERM is over
+	kill *time.Timer
+}
 
-	// Open the log file
-	path := syncLogs + "/" + short + "-" + month + ".log"
-	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0640)
-	if err != nil {
-		logging.Warn("failed to open log file ", path, err)
+// Run runs the command and stops the SIGKILL timer once it has exited
+func (c *syncCommand) Run() error {
+	err := c.Cmd.Run()
+	// Cancel always returns before Wait does, the group is gone and its id could be reused
+	if c.kill != nil {
+		c.kill.Stop()
 	}
+	return err
+}
+
+// commandContext prepares a command that is stopped once ctx is done
+// The command runs in its own process group so that everything it started receives
+// SIGTERM, anything still running after syncGracePeriod is sent SIGKILL
+func commandContext(ctx context.Context, name string, args ...string) *syncCommand {
+	command := &syncCommand{Cmd: exec.CommandContext(ctx, name, args...)}
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error {
+		group := -command.Process.Pid
+		command.kill = time.AfterFunc(syncGracePeriod, func() {
+			syscall.Kill(group, syscall.SIGKILL)
+		})
+		return syscall.Kill(group, syscall.SIGTERM)
+	}
+	// Stop waiting on the output of any orphaned children shortly after the group is killed
+	command.WaitDelay = syncGracePeriod + 10*time.Second
 
-	if admGroup != 0 {
-		// Set the file to be owned by the adm group
-		err = file.Chown(os.Getuid(), admGroup)
+	return command
+}
+
+// script prepares the command for a script style project
+// The command is never run through a shell. ${VAR} in the command, arguments and
+// working directory is replaced with the project's env or the process's environment
+func script(ctx context.Context, project *Project) (*syncCommand, error) {
+	lookup := func(key string) string {
+		if value, ok := project.Script.Env[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	}
+
+	program := project.Script.Command
+	args := project.Script.Arguments
+
+	// The command is a full command line
+	if project.Script.Split {
+		words, err := splitCommandLine(program)
 		if err != nil {
-			logging.Warn("failed to set log file ownership", path, err)
+			return nil, err
 		}
+		if len(words) == 0 {
+			return nil, errors.New("command is empty")
+		}
+
+		program = words[0]
+		args = append(words[1:], args...)
 	}
 
-	// Write to the log file
-	_, err = file.Write(data)
-	if err != nil {
-		logging.Warn("failed to write to log file ", path, err)
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = expandVariables(arg, lookup)
+	}
+
+	command := commandContext(ctx, expandVariables(program, lookup), expanded...)
+	command.Dir = expandVariables(project.Script.Dir, lookup)
+
+	// Add the project's environment variables on top of our own
+	command.Env = os.Environ()
+	for key, value := range project.Script.Env {
+		command.Env = append(command.Env, key+"="+expandVariables(value, os.Getenv))
 	}
+
+	return command, nil
+}
+
+var reVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandVariables replaces ${VAR} with lookup("VAR")
+// Unlike os.Expand a bare $VAR is left alone so arguments meant for another program are untouched
+func expandVariables(s string, lookup func(string) string) string {
+	return reVariable.ReplaceAllStringFunc(s, func(match string) string {
+		return lookup(match[2 : len(match)-1])
+	})
+}
+
+// splitCommandLine splits a command line into words like a shell would but without any expansions
+// Words are separated by unquoted whitespace. Single quotes keep everything literally,
+// inside double quotes and outside of quotes a backslash escapes the next character
+func splitCommandLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\' && (quote == 0 || quote == '"'):
+			if i+1 == len(runes) {
+				return nil, errors.New("command ends with an unfinished escape")
+			}
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case unicode.IsSpace(c):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("command has an unterminated %c quote", quote)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
 }
 
 func syncProject(config *ConfigFile, status RSYNCStatus, short string) {
 	logging.Info("Running job: SYNC", short)
+	project := config.Mirrors[short]
+
+	// The sync is stopped if it runs past its timeout or is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	if project.SyncTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), project.SyncTimeout)
+	}
+	defer cancel()
 
 	// Lock the project
 	syncLock.Lock()
@@ -129,71 +295,120 @@ func syncProject(config *ConfigFile, status RSYNCStatus, short string) {
 		return
 	}
 	syncLocks[short] = true
+	syncCancels[short] = cancel
 	syncLock.Unlock()
 
-	start := time.Now()
+	// Unlock the project once we are done
+	defer func() {
+		unwatchSyncOutput(short)
 
-	if config.Mirrors[short].SyncStyle == "rsync" {
-		// 1 stage syncs are the norm
-		output1, state1 := rsync(config.Mirrors[short], config.Mirrors[short].Rsync.Options)
-		status[short].Push(Status{StartTime: start.Unix(), EndTime: time.Now().Unix(), ExitCode: state1.ExitCode()})
+		syncLock.Lock()
+		syncLocks[short] = false
+		delete(syncCancels, short)
+		syncLock.Unlock()
+	}()
 
-		// append stage 1 to its log file
-		if syncLogs != "" {
-			appendToLogFile(short, []byte("\n\n"+start.Format(time.RFC1123)+"\n"))
-			appendToLogFile(short, output1)
+	if project.SyncStyle == "rsync" {
+		// 1 stage syncs are the norm, 2 stage syncs happen sometimes and a few mirrors are 3 stage syncs
+		stages := []string{project.Rsync.Options}
+		if project.Rsync.Second != "" {
+			stages = append(stages, project.Rsync.Second)
 		}
-
-		checkRSYNCState(short, state1, output1)
-
-		// 2 stage syncs happen sometimes
-		if config.Mirrors[short].Rsync.Second != "" {
-			start = time.Now()
-			output2, state2 := rsync(config.Mirrors[short], config.Mirrors[short].Rsync.Second)
-			status[short].Push(Status{StartTime: start.Unix(), EndTime: time.Now().Unix(), ExitCode: state2.ExitCode()})
-
-			if syncLogs != "" {
-				appendToLogFile(short, []byte("\n\n"+start.Format(time.RFC1123)+"\n"))
-				appendToLogFile(short, output2)
-			}
-
-			checkRSYNCState(short, state2, output2)
+		if project.Rsync.Third != "" {
+			stages = append(stages, project.Rsync.Third)
 		}
 
-		// A few mirrors are 3 stage syncs
-		if config.Mirrors[short].Rsync.Third != "" {
-			start = time.Now()
-			output3, state3 := rsync(config.Mirrors[short], config.Mirrors[short].Rsync.Third)
-			status[short].Push(Status{StartTime: start.Unix(), EndTime: time.Now().Unix(), ExitCode: state3.ExitCode()})
-
-			if syncLogs != "" {
-				appendToLogFile(short, []byte("\n\n"+start.Format(time.RFC1123)+"\n"))
-				appendToLogFile(short, output3)
+		for i, options := range stages {
+			start := time.Now()
+			output := NewSyncOutput(short, fmt.Sprintf("stage %d", i+1))
+			state := rsync(ctx, project, options, output)
+			entry := Status{StartTime: start.Unix(), EndTime: time.Now().Unix(), ExitCode: state.ExitCode()}
+			interrupted := checkInterrupted(ctx, &entry, state)
+			status.Push(short, entry)
+			output.Printf("exited with code %d after %s", entry.ExitCode, entry.Duration())
+
+			if interrupted {
+				// The remaining stages are skipped
+				reportInterrupted(project, entry, output.Tail())
+				break
 			}
 
-			checkRSYNCState(short, state3, output3)
+			checkRSYNCState(short, state, output.Tail())
 		}
-	} else if config.Mirrors[short].SyncStyle == "script" {
+	} else if project.SyncStyle == "script" {
 		if syncDryRun {
 			logging.Info("Did not sync", short, "because --dry-run was specified")
 			return
 		}
 
+		start := time.Now()
+
 		// Execute the script
-		logging.Info(config.Mirrors[short].Script.Command, config.Mirrors[short].Script.Arguments)
-		command := exec.Command(config.Mirrors[short].Script.Command, config.Mirrors[short].Script.Arguments...)
-		output, _ := command.CombinedOutput()
+		command, err := script(ctx, project)
+		if err != nil {
+			status.Push(short, Status{StartTime: start.Unix(), EndTime: time.Now().Unix(), ExitCode: -1})
+			logging.Error("Job script: ", short, " has an invalid command. ", err)
+			return
+		}
+
+		logging.Info(command)
+		output := NewSyncOutput(short, "script")
+		output.Printf("%s", command)
 
-		if syncLogs != "" {
-			appendToLogFile(short, []byte("\n\n"+start.Format(time.RFC1123)+"\n"))
-			appendToLogFile(short, output)
+		command.Stdout = output
+		command.Stderr = output
+		err = command.Run()
+		output.Close()
+
+		entry := Status{StartTime: start.Unix(), EndTime: time.Now().Unix(), ExitCode: command.ProcessState.ExitCode()}
+		interrupted := checkInterrupted(ctx, &entry, command.ProcessState)
+		status.Push(short, entry)
+		output.Printf("exited with code %d after %s", entry.ExitCode, entry.Duration())
+
+		if interrupted {
+			reportInterrupted(project, entry, output.Tail())
+		} else {
+			checkScriptState(short, command.ProcessState, output.Tail(), err)
 		}
 	}
+}
 
-	// Unlock the project
+// cancelSync stops the running sync of a project
+// Returns false if the project is not currently syncing
+func cancelSync(short string) bool {
 	syncLock.Lock()
-	syncLocks[short] = false
+	cancel, ok := syncCancels[short]
 	syncLock.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// checkInterrupted marks entry if the command was stopped because ctx is done
+func checkInterrupted(ctx context.Context, entry *Status, state *os.ProcessState) bool {
+	if state != nil && state.Success() {
+		return false
+	}
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		entry.TimedOut = true
+	case context.Canceled:
+		entry.Cancelled = true
+	default:
+		return false
+	}
+	return true
+}
+
+func reportInterrupted(project *Project, entry Status, output []byte) {
+	if entry.TimedOut {
+		logging.ErrorWithAttachment(output, "Job ", project.SyncStyle, ": ", project.Short, " timed out after ", project.SyncTimeout, " and was stopped")
+	} else {
+		logging.WarnToDiscord("Job ", project.SyncStyle, ": ", project.Short, " was cancelled")
+	}
 }
 
 // handleSyncs is the main scheduler
@@ -201,14 +416,8 @@ func syncProject(config *ConfigFile, status RSYNCStatus, short string) {
 // tasks are run in a separate goroutine and there is a lock to prevent the same project from being synced simultaneously
 // the stop channel gracefully stops the scheduler after all active rsync tasks have completed
 // the manual channel is used to manually sync a project, assuming it is not already currently syncing
+// status should be created by NewRSYNCStatus with the same config
 func handleSyncs(config *ConfigFile, status RSYNCStatus, manual <-chan string, stop chan struct{}) {
-	for _, mirror := range config.Mirrors {
-		if mirror.Rsync.SyncsPerDay > 0 {
-			// Store a weeks worth of status messages in memory
-			status[mirror.Short] = datarithms.CircularQueueInit[Status](7 * mirror.Rsync.SyncsPerDay)
-		}
-	}
-
 	// prepare the tasks
 	tasks := make([]datarithms.Task, 0, len(config.Mirrors))
 	for _, mirror := range config.Mirrors {
@@ -235,11 +444,15 @@ func handleSyncs(config *ConfigFile, status RSYNCStatus, manual <-chan string, s
 	}
 
 	// a project can only be syncing once at a time
-	syncLock = sync.Mutex{}
+	// syncLock is shared with the webserver so it is never replaced
+	syncLock.Lock()
 	syncLocks = make(map[string]bool)
+	syncCancels = make(map[string]context.CancelFunc)
 	for _, project := range config.Mirrors {
 		syncLocks[project.Short] = false
 	}
+	syncSchedule = scheduleOffsets(tasks)
+	syncLock.Unlock()
 
 	// skip the first job
 	_, sleep := schedule.NextJob()
@@ -307,6 +520,16 @@ func checkRSYNCState(short string, state *os.ProcessState, output []byte) {
 	}
 }
 
+func checkScriptState(short string, state *os.ProcessState, output []byte, err error) {
+	if state == nil {
+		logging.ErrorWithAttachment(output, "Job script: ", short, " could not be started. ", err)
+	} else if state.Success() {
+		logging.Success("Job script:", short, "finished successfully")
+	} else {
+		logging.ErrorWithAttachment(output, "Job script: ", short, " failed. Exit code: ", state.ExitCode())
+	}
+}
+
 // On start up then once a week checks and deletes all logs older than 3 months
 func checkOldLogs() {
 	ticker := time.NewTicker(168 * time.Hour)
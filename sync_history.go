@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/COSI-Lab/datarithms"
+	"github.com/COSI-Lab/logging"
+)
+
+// Sync history is kept in memory in the RSYNCStatus circular queues and
+// mirrored to disk as one JSON encoded Status per line in SYNC_HISTORY/{short}.jsonl
+// so that it survives restarts and config reloads
+
+// Duration of the sync stage
+func (s Status) Duration() time.Duration {
+	return time.Duration(s.EndTime-s.StartTime) * time.Second
+}
+
+// Success is true if the stage exited cleanly
+func (s Status) Success() bool {
+	return s.ExitCode == 0 && !s.TimedOut && !s.Cancelled
+}
+
+// Start time of the stage
+func (s Status) Start() time.Time {
+	return time.Unix(s.StartTime, 0)
+}
+
+// End time of the stage
+func (s Status) End() time.Time {
+	return time.Unix(s.EndTime, 0)
+}
+
+// Meaning is a human readable description of the exit code
+func (s Status) Meaning() string {
+	if s.TimedOut {
+		return "Timed out"
+	}
+	if s.Cancelled {
+		return "Cancelled"
+	}
+	if meaning, ok := rsyncErrorCodes[s.ExitCode]; ok {
+		return meaning
+	}
+	return "Unknown error"
+}
+
+// historyCapacity is how many stages we remember for a project
+func historyCapacity(project *Project) int {
+	if project.SyncStyle == "script" {
+		// Store a weeks worth of status messages
+		return 7 * project.Script.SyncsPerDay
+	}
+
+	stages := 1
+	if project.Rsync.Second != "" {
+		stages++
+	}
+	if project.Rsync.Third != "" {
+		stages++
+	}
+
+	// Store a weeks worth of status messages
+	return 7 * stages * project.Rsync.SyncsPerDay
+}
+
+// NewRSYNCStatus creates a history queue for every project that is synced by the scheduler
+// Entries are copied from previous if the project was already tracked there,
+// otherwise they are loaded from SYNC_HISTORY if it is set
+func NewRSYNCStatus(config *ConfigFile, previous RSYNCStatus) RSYNCStatus {
+	status := make(RSYNCStatus)
+	for _, mirror := range config.Mirrors {
+		capacity := historyCapacity(mirror)
+		if capacity == 0 {
+			continue
+		}
+
+		// CircularQueue.All() returns nothing once the queue is completely full
+		// so we always leave one slot free, see RSYNCStatus.Push
+		status[mirror.Short] = datarithms.CircularQueueInit[Status](capacity + 1)
+
+		var entries []Status
+		if old, ok := previous[mirror.Short]; ok {
+			entries = old.All()
+		} else if syncHistory != "" {
+			entries = loadSyncHistory(mirror.Short, capacity)
+		}
+
+		for _, entry := range entries {
+			status.push(mirror.Short, entry)
+		}
+	}
+	return status
+}
+
+// push adds an entry to the in memory queue without persisting it
+func (status RSYNCStatus) push(short string, entry Status) {
+	queue, ok := status[short]
+	if !ok {
+		return
+	}
+
+	if queue.Len() >= queue.Capacity()-1 {
+		queue.Pop()
+	}
+	queue.Push(entry)
+}
+
+// Push records the result of a sync stage in memory and in SYNC_HISTORY
+func (status RSYNCStatus) Push(short string, entry Status) {
+	status.push(short, entry)
+
+	if syncHistory != "" {
+		appendSyncHistory(short, entry)
+	}
+}
+
+// History returns the recorded stages of a project from oldest to newest
+func (status RSYNCStatus) History(short string) []Status {
+	queue, ok := status[short]
+	if !ok {
+		return nil
+	}
+	return queue.All()
+}
+
+// LastSuccess returns the most recent successful stage
+func (status RSYNCStatus) LastSuccess(short string) (Status, bool) {
+	history := status.History(short)
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Success() {
+			return history[i], true
+		}
+	}
+	return Status{}, false
+}
+
+// LastFailure returns the most recent failed stage
+func (status RSYNCStatus) LastFailure(short string) (Status, bool) {
+	history := status.History(short)
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].Success() {
+			return history[i], true
+		}
+	}
+	return Status{}, false
+}
+
+func syncHistoryPath(short string) string {
+	return filepath.Join(syncHistory, short+".jsonl")
+}
+
+func appendSyncHistory(short string, entry Status) {
+	path := syncHistoryPath(short)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		logging.Warn("failed to open sync history", path, err)
+		return
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logging.Warn("failed to encode sync history", err)
+		return
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		logging.Warn("failed to write sync history", path, err)
+	}
+}
+
+// loadSyncHistory reads the last `capacity` entries of a project's history file
+// The file is rewritten with only those entries so it doesn't grow forever
+func loadSyncHistory(short string, capacity int) []Status {
+	path := syncHistoryPath(short)
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warn("failed to open sync history", path, err)
+		}
+		return nil
+	}
+
+	entries := make([]Status, 0, capacity)
+	total := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Status
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			logging.Warn("skipping corrupt sync history line in", path, err)
+			continue
+		}
+
+		total++
+		entries = append(entries, entry)
+		if len(entries) > capacity {
+			entries = entries[1:]
+		}
+	}
+	file.Close()
+
+	if total > len(entries) {
+		compactSyncHistory(path, entries)
+	}
+
+	return entries
+}
+
+// compactSyncHistory atomically replaces the history file with entries
+func compactSyncHistory(path string, entries []Status) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		logging.Warn("failed to compact sync history", path, err)
+		return
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		logging.Warn("failed to compact sync history", path, err)
+		os.Remove(tmp)
+		return
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		logging.Warn("failed to compact sync history", path, err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/COSI-Lab/logging"
+)
+
+// syncOutputTail is how many bytes of a sync's output are kept in memory for discord attachments
+const syncOutputTail = 64 * 1024
+
+// logFile is an open monthly sync log
+type logFile struct {
+	file  *os.File
+	month time.Month
+}
+
+// Open monthly log files are shared by every sync of a project
+// They are only reopened (and chowned) when the month changes
+var logFiles = make(map[string]*logFile)
+var logFilesLock sync.Mutex
+
+// appendToLogFile writes data to the project's log file for the current month
+func appendToLogFile(short string, data []byte) {
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+
+	month := time.Now().UTC().Month()
+	current, ok := logFiles[short]
+	if !ok || current.month != month {
+		if ok {
+			current.file.Close()
+			delete(logFiles, short)
+		}
+
+		// Open the log file
+		path := fmt.Sprintf("%s/%s-%02d.log", syncLogs, short, month)
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0640)
+		if err != nil {
+			logging.Warn("failed to open log file ", path, err)
+			return
+		}
+
+		if admGroup != 0 {
+			// Set the file to be owned by the adm group
+			err = file.Chown(os.Getuid(), admGroup)
+			if err != nil {
+				logging.Warn("failed to set log file ownership", path, err)
+			}
+		}
+
+		current = &logFile{file: file, month: month}
+		logFiles[short] = current
+	}
+
+	// Write to the log file
+	_, err := current.file.Write(data)
+	if err != nil {
+		logging.Warn("failed to write to log file ", current.file.Name(), err)
+	}
+}
+
+// SyncOutput collects the stdout and stderr of a sync stage as it runs
+// Each complete line is written to the monthly log file prefixed with a timestamp and the stage
+// and sent to anyone following the sync live. Only the last syncOutputTail bytes are kept in memory
+type SyncOutput struct {
+	short string
+	stage string
+
+	lock    sync.Mutex
+	partial []byte
+	tail    []byte
+}
+
+// NewSyncOutput creates the output for one stage of a project's sync
+// It replaces the previous stage as the output followed by /sync/{project}/log
+func NewSyncOutput(short, stage string) *SyncOutput {
+	output := &SyncOutput{short: short, stage: stage}
+	watchSyncOutput(output)
+	return output
+}
+
+// Write implements io.Writer so SyncOutput can be used as the Stdout and Stderr of a command
+func (o *SyncOutput) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i == -1 {
+			break
+		}
+
+		o.line(o.partial[:i])
+		o.partial = o.partial[i+1:]
+	}
+
+	// A line without a newline this long is most likely a progress bar, flush it anyway
+	if len(o.partial) > syncOutputTail {
+		o.line(o.partial)
+		o.partial = nil
+	}
+
+	return len(p), nil
+}
+
+// Printf writes a message of our own to the output
+func (o *SyncOutput) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(o, format+"\n", a...)
+}
+
+// Close flushes any unfinished line
+func (o *SyncOutput) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if len(o.partial) > 0 {
+		o.line(o.partial)
+		o.partial = nil
+	}
+
+	return nil
+}
+
+// Tail returns a copy of the last syncOutputTail bytes of output
+func (o *SyncOutput) Tail() []byte {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	tail := o.tail
+	if len(tail) > syncOutputTail {
+		tail = tail[len(tail)-syncOutputTail:]
+	}
+	return append([]byte(nil), tail...)
+}
+
+// line records one complete line, the caller must hold the lock
+func (o *SyncOutput) line(text []byte) {
+	line := fmt.Sprintf("%s [%s] %s\n", time.Now().Format(time.RFC3339), o.stage, text)
+
+	if syncLogs != "" {
+		appendToLogFile(o.short, []byte(line))
+	}
+
+	publishSyncLine(o.short, line)
+
+	o.tail = append(o.tail, line...)
+	if len(o.tail) > 2*syncOutputTail {
+		o.tail = append(o.tail[:0], o.tail[len(o.tail)-syncOutputTail:]...)
+	}
+}
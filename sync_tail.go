@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/COSI-Lab/datarithms"
+	"github.com/COSI-Lab/logging"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Live sync output is fanned out from SyncOutput to every websocket following that project
+
+var syncTailLock sync.Mutex
+
+// Subscribed websocket clients for each project
+var syncTailClients = make(map[string]map[chan string]struct{})
+
+// The output of the stage that is currently running for each project
+var syncTailOutputs = make(map[string]*SyncOutput)
+
+// syncSchedule is when each project is synced as offsets from midnight UTC, protected by syncLock
+var syncSchedule map[string][]time.Duration
+
+// watchSyncOutput makes output the running stage of its project
+func watchSyncOutput(output *SyncOutput) {
+	syncTailLock.Lock()
+	syncTailOutputs[output.short] = output
+	syncTailLock.Unlock()
+}
+
+// unwatchSyncOutput is called once a project's sync is over
+func unwatchSyncOutput(short string) {
+	syncTailLock.Lock()
+	delete(syncTailOutputs, short)
+	syncTailLock.Unlock()
+}
+
+// publishSyncLine sends a line of output to everyone following the project
+func publishSyncLine(short, line string) {
+	syncTailLock.Lock()
+	for client := range syncTailClients[short] {
+		select {
+		case client <- line:
+		default:
+			// If the client blocks we skip it
+		}
+	}
+	syncTailLock.Unlock()
+}
+
+// subscribeSyncOutput starts following a project, the backlog is the recent output of the running stage
+func subscribeSyncOutput(short string) (client chan string, backlog []byte) {
+	syncTailLock.Lock()
+	output := syncTailOutputs[short]
+	client = make(chan string, 256)
+	if syncTailClients[short] == nil {
+		syncTailClients[short] = make(map[chan string]struct{})
+	}
+	syncTailClients[short][client] = struct{}{}
+	syncTailLock.Unlock()
+
+	// Read the backlog without holding syncTailLock because the output takes it while publishing
+	if output != nil {
+		backlog = output.Tail()
+	}
+
+	return client, backlog
+}
+
+func unsubscribeSyncOutput(short string, client chan string) {
+	syncTailLock.Lock()
+	delete(syncTailClients[short], client)
+	syncTailLock.Unlock()
+}
+
+// isSyncing is true while a project is being synced
+func isSyncing(short string) bool {
+	syncLock.Lock()
+	defer syncLock.Unlock()
+	return syncLocks[short]
+}
+
+// scheduleOffsets returns when each task runs as an offset from midnight UTC
+// tasks must be the ones given to datarithms.BuildSchedule, the jobs are laid out the same way
+// and with the same float32 fractions of a day so the offsets match the scheduler's
+func scheduleOffsets(tasks []datarithms.Task) map[string][]time.Duration {
+	total := 0
+	lcm := 1
+	for _, task := range tasks {
+		if task.Syncs <= 0 {
+			continue
+		}
+		total += task.Syncs
+
+		a, b := lcm, task.Syncs
+		for b != 0 {
+			a, b = b, a%b
+		}
+		lcm = lcm * task.Syncs / a
+	}
+
+	offsets := make(map[string][]time.Duration)
+	if total == 0 {
+		return offsets
+	}
+
+	var interval float32 = 1.0 / float32(total)
+	c := 0
+	for i := 0; i < lcm; i++ {
+		for _, task := range tasks {
+			if task.Syncs > 0 && i%(lcm/task.Syncs) == 0 {
+				target := interval * float32(c)
+				offset := time.Duration(float64(target) * float64(24*time.Hour)).Round(time.Second)
+				offsets[task.Short] = append(offsets[task.Short], offset)
+				c++
+			}
+		}
+	}
+
+	return offsets
+}
+
+// nextSync returns the next time the scheduler will sync the project
+func nextSync(short string) (time.Time, bool) {
+	syncLock.Lock()
+	offsets := syncSchedule[short]
+	syncLock.Unlock()
+
+	if len(offsets) == 0 {
+		return time.Time{}, false
+	}
+
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	i := sort.Search(len(offsets), func(i int) bool {
+		return midnight.Add(offsets[i]).After(now)
+	})
+
+	if i == len(offsets) {
+		return midnight.Add(24 * time.Hour).Add(offsets[0]), true
+	}
+	return midnight.Add(offsets[i]), true
+}
+
+// SyncLogPage is the data for the /sync/{project}/log page
+type SyncLogPage struct {
+	Project   *Project
+	Syncing   bool
+	Scheduled bool
+	NextSync  time.Time
+}
+
+// handleSyncLog lets a privileged user follow the output of a project's sync live
+// Without a websocket upgrade it returns a page that connects back to the same url
+// /sync/{project}/log?token={token}
+func handleSyncLog(w http.ResponseWriter, r *http.Request) {
+	short := mux.Vars(r)["project"]
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "No token provided", http.StatusBadRequest)
+		return
+	}
+
+	dataLock.RLock()
+	project, ok := projects[short]
+	dataLock.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if _, ok := validToken(project, token); !ok {
+		http.Error(w, "Invalid access token", http.StatusForbidden)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		serveSyncLog(w, r, short)
+		return
+	}
+
+	page := SyncLogPage{
+		Project: project,
+		Syncing: isSyncing(short),
+	}
+	page.NextSync, page.Scheduled = nextSync(short)
+
+	err := tmpls.ExecuteTemplate(w, "synclog.gohtml", page)
+	if err != nil {
+		logging.Warn("handleSyncLog;", err)
+	}
+}
+
+// serveSyncLog streams each line of the project's sync output as a text message
+func serveSyncLog(w http.ResponseWriter, r *http.Request, short string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logging.Warn(err)
+		return
+	}
+	defer conn.Close()
+
+	client, backlog := subscribeSyncOutput(short)
+	defer unsubscribeSyncOutput(short, client)
+
+	// We never expect messages from the browser but we have to read to notice it closing
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	if len(backlog) > 0 {
+		err = conn.WriteMessage(websocket.TextMessage, backlog)
+		if err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case line := <-client:
+			err = conn.WriteMessage(websocket.TextMessage, []byte(line))
+			if err != nil {
+				logging.Info("Closing sync log connection", err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/COSI-Lab/logging"
+)
+
+// Access tokens let people start, cancel and follow the syncs of a project
+// tokens.txt only stores a salted sha256 of each token, one per line:
+//
+//	project:name:salt:hash
+//	project:name:salt:hash:2025-12-31
+//
+// The optional last field is the day the token expires. Lines are made with `Mirror mint-token`
+// The old "project:token" lines with the token in plain text still work but are reported by check-config
+
+// AccessToken is a named token of a project
+type AccessToken struct {
+	Name string
+	Salt []byte
+	Hash []byte
+	// Expires is the end of the last day the token can be used, the zero time never expires
+	Expires time.Time
+}
+
+// tokenExpiryFormat is the layout of the expiry date in tokens.txt
+const tokenExpiryFormat = "2006-01-02"
+
+// reTokenName limits token names to something that is safe to log
+var reTokenName = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// hashToken returns the salted hash of a token
+func hashToken(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+// parseTokens reads the access tokens file and adds the tokens to their projects
+func parseTokens(config *ConfigFile, tokensFile string) error {
+	// Read line by line
+	file, err := os.Open(tokensFile)
+	if err != nil {
+		return fmt.Errorf("could not open access tokens file: %w", err)
+	}
+	defer file.Close()
+
+	var problems []string
+	n := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Split(line, ":")
+
+		var token AccessToken
+		switch {
+		case len(fields) == 2 && fields[0] != "" && fields[1] != "":
+			// The old format, the token is hashed here so it is compared like the others
+			token.Name = "legacy"
+			token.Salt = make([]byte, 16)
+			rand.Read(token.Salt)
+			token.Hash = hashToken(token.Salt, fields[1])
+			config.tokenWarnings = append(config.tokenWarnings, fmt.Sprintf("%s line %d: the token of %s is stored in plain text, replace it with one from `Mirror mint-token`", tokensFile, n, fields[0]))
+		case len(fields) == 4 || len(fields) == 5:
+			token.Name = fields[1]
+			token.Salt, err = hex.DecodeString(fields[2])
+			if err == nil {
+				token.Hash, err = hex.DecodeString(fields[3])
+			}
+			if err != nil || len(token.Salt) == 0 || len(token.Hash) != sha256.Size {
+				problems = append(problems, fmt.Sprintf("%s line %d: the salt and hash must be hex", tokensFile, n))
+				continue
+			}
+			if !reTokenName.MatchString(token.Name) {
+				problems = append(problems, fmt.Sprintf("%s line %d: the token name %q may only have letters, digits and _.@-", tokensFile, n, token.Name))
+				continue
+			}
+			if len(fields) == 5 {
+				day, err := time.ParseInLocation(tokenExpiryFormat, fields[4], time.Local)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s line %d: the expiry must look like %s", tokensFile, n, tokenExpiryFormat))
+					continue
+				}
+				token.Expires = day.AddDate(0, 0, 1)
+			}
+		default:
+			// Random text that doesn't match is ignored
+			continue
+		}
+
+		// Tokens often outlive the project they were made for, that shouldn't stop a reload
+		project, ok := config.Mirrors[fields[0]]
+		if !ok {
+			config.tokenWarnings = append(config.tokenWarnings, fmt.Sprintf("%s line %d: %s is not a project, the token is skipped", tokensFile, n, fields[0]))
+			continue
+		}
+		for _, other := range project.AccessTokens {
+			if other.Name == token.Name && token.Name != "legacy" {
+				problems = append(problems, fmt.Sprintf("%s line %d: %s already has a token named %s", tokensFile, n, fields[0], token.Name))
+			}
+		}
+		project.AccessTokens = append(project.AccessTokens, token)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read access tokens file: %w", err)
+	}
+
+	if len(problems) > 0 {
+		return ConfigError(problems)
+	}
+	return nil
+}
+
+// checkToken returns the name of the project's token that matches, expired tokens never match
+func (project *Project) checkToken(token string) (string, bool) {
+	now := time.Now()
+	for _, t := range project.AccessTokens {
+		if !t.Expires.IsZero() && now.After(t.Expires) {
+			continue
+		}
+		if subtle.ConstantTimeCompare(hashToken(t.Salt, token), t.Hash) == 1 {
+			return t.Name, true
+		}
+	}
+	return "", false
+}
+
+// isPullToken is true if token is the master pull token
+func isPullToken(token string) bool {
+	if pullToken == "" {
+		return false
+	}
+	// Hashing first keeps the comparison from leaking the length of the pull token
+	a := sha256.Sum256([]byte(token))
+	b := sha256.Sum256([]byte(pullToken))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// validToken returns the name of the token if it is the master pull token or one of the project's access tokens
+func validToken(project *Project, token string) (string, bool) {
+	if isPullToken(token) {
+		return "master", true
+	}
+	return project.checkToken(token)
+}
+
+// mintToken creates a random token and the line of tokens.txt that accepts it
+func mintToken(project, name, expires string) (token, line string, err error) {
+	if !reTokenName.MatchString(name) {
+		return "", "", fmt.Errorf("the token name %q may only have letters, digits and _.@-", name)
+	}
+	if expires != "" {
+		_, err = time.Parse(tokenExpiryFormat, expires)
+		if err != nil {
+			return "", "", fmt.Errorf("the expiry must look like %s", tokenExpiryFormat)
+		}
+	}
+
+	secret := make([]byte, 32)
+	salt := make([]byte, 16)
+	_, err = rand.Read(secret)
+	if err == nil {
+		_, err = rand.Read(salt)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(secret)
+	line = strings.Join([]string{project, name, hex.EncodeToString(salt), hex.EncodeToString(hashToken(salt, token))}, ":")
+	if expires != "" {
+		line += ":" + expires
+	}
+	return token, line, nil
+}
+
+// auditEntry is a line of the audit log
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Project string    `json:"project"`
+	Token   string    `json:"token"`
+	Client  string    `json:"client"`
+}
+
+// auditLock keeps the lines of the audit log whole
+var auditLock sync.Mutex
+
+// audit records that a token was used. Lines are appended to SYNC_AUDIT_LOG as json if it is set
+func audit(r *http.Request, action, project, token string) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	// nginx on the same machine passes the address of the visitor along, anyone else could make it up
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && net.ParseIP(client).IsLoopback() {
+		client = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+
+	logging.Info("Audit:", action, project, "with token", token, "from", client)
+	if syncAuditLog == "" {
+		return
+	}
+
+	line, err := json.Marshal(auditEntry{Time: time.Now(), Action: action, Project: project, Token: token, Client: client})
+	if err != nil {
+		return
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	f, err := os.OpenFile(syncAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		logging.Warn("Failed to open the audit log", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		logging.Warn("Failed to write the audit log", err)
+	}
+}
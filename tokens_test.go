@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseTestTokens parses lines as tokens.txt for a config with the arch and debian projects
+func parseTestTokens(t *testing.T, lines ...string) (*ConfigFile, error) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.txt")
+	err := os.WriteFile(tokensFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ConfigFile{Mirrors: map[string]*Project{
+		"arch":   {Short: "arch"},
+		"debian": {Short: "debian"},
+	}}
+	return config, parseTokens(config, tokensFile)
+}
+
+// mintTestToken mints a token or fails the test
+func mintTestToken(t *testing.T, project, name, expires string) (token, line string) {
+	token, line, err := mintToken(project, name, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, line
+}
+
+func TestMintedToken(t *testing.T) {
+	token, line := mintTestToken(t, "arch", "alice", "")
+	other, otherLine := mintTestToken(t, "debian", "bob", "")
+
+	config, err := parseTestTokens(t, line, otherLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Warnings()) != 0 {
+		t.Errorf("got warnings %v", config.Warnings())
+	}
+
+	name, ok := config.Mirrors["arch"].checkToken(token)
+	if !ok || name != "alice" {
+		t.Errorf("checkToken = %s, %v", name, ok)
+	}
+	// Tokens only work for their own project
+	if _, ok := config.Mirrors["arch"].checkToken(other); ok {
+		t.Error("the token of debian was accepted for arch")
+	}
+	if _, ok := config.Mirrors["arch"].checkToken(token + "x"); ok {
+		t.Error("a wrong token was accepted")
+	}
+
+	// Only the salted hash is stored
+	if strings.Contains(line, token) {
+		t.Error("the token is in the tokens.txt line")
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	yesterday := time.Now().AddDate(0, 0, -1).Format(tokenExpiryFormat)
+	today := time.Now().Format(tokenExpiryFormat)
+	expired, expiredLine := mintTestToken(t, "arch", "expired", yesterday)
+	valid, validLine := mintTestToken(t, "arch", "valid", today)
+
+	config, err := parseTestTokens(t, expiredLine, validLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := config.Mirrors["arch"].checkToken(expired); ok {
+		t.Error("a token past its expiry day was accepted")
+	}
+	// The expiry day itself is still valid
+	if name, ok := config.Mirrors["arch"].checkToken(valid); !ok || name != "valid" {
+		t.Errorf("the token expiring today was rejected: %s, %v", name, ok)
+	}
+
+	_, _, err = mintToken("arch", "bad", "31/12/2025")
+	if err == nil {
+		t.Error("a malformed expiry was minted")
+	}
+}
+
+func TestUnknownProjectToken(t *testing.T) {
+	_, gone := mintTestToken(t, "gone", "alice", "")
+	token, line := mintTestToken(t, "arch", "alice", "")
+
+	// A project removed from mirrors.json only warns, the rest of the file still loads
+	config, err := parseTestTokens(t, gone, "gone:legacySecret", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := strings.Join(config.Warnings(), "\n")
+	if !strings.Contains(warnings, "line 1: gone is not a project") || !strings.Contains(warnings, "line 2: gone is not a project") {
+		t.Errorf("got warnings %q", warnings)
+	}
+	if _, ok := config.Mirrors["arch"].checkToken(token); !ok {
+		t.Error("the token after the unknown project was not loaded")
+	}
+}
+
+func TestDuplicateTokenName(t *testing.T) {
+	_, first := mintTestToken(t, "arch", "alice", "")
+	_, second := mintTestToken(t, "arch", "alice", "")
+	_, other := mintTestToken(t, "debian", "alice", "")
+
+	_, err := parseTestTokens(t, first, other, second)
+	if err == nil || !strings.Contains(err.Error(), "line 3: arch already has a token named alice") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestMalformedTokens(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"arch:alice:zz:00", "must be hex"},
+		{"arch:alice:00ff:00ff", "must be hex"},
+		{"arch:ali ce:00ff:" + strings.Repeat("00", 32), "may only have"},
+		{"arch:alice:00ff:" + strings.Repeat("00", 32) + ":tomorrow", "expiry must look like"},
+	}
+
+	for _, test := range tests {
+		_, err := parseTestTokens(t, test.line)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error about %s", test.line, err, test.err)
+		}
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	config, err := parseTestTokens(t, "arch:someLongSecret", "# comments and other text are ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, ok := config.Mirrors["arch"].checkToken("someLongSecret")
+	if !ok || name != "legacy" {
+		t.Errorf("checkToken = %s, %v", name, ok)
+	}
+	if _, ok := config.Mirrors["debian"].checkToken("someLongSecret"); ok {
+		t.Error("the legacy token of arch was accepted for debian")
+	}
+
+	// check-config asks for it to be replaced
+	warnings := config.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "plain text") {
+		t.Errorf("got warnings %v", warnings)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// TopK approximately tracks the most frequent keys using a bounded amount of memory
+// It uses the space-saving algorithm: once full, a new key replaces the least frequent key and inherits its count.
+// Count is then an overestimate by at most Error
+type TopK struct {
+	capacity int
+	counts   map[string]*TopKEntry
+}
+
+// TopKEntry is a key and how often it was seen
+type TopKEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+	Error int64  `json:"error,omitempty"`
+}
+
+func NewTopK(capacity int) *TopK {
+	return &TopK{
+		capacity: capacity,
+		counts:   make(map[string]*TopKEntry, capacity),
+	}
+}
+
+// Add counts one occurrence of key
+func (t *TopK) Add(key string) {
+	t.AddN(key, 1)
+}
+
+// AddN counts key n times, n can be a weight such as a number of bytes
+func (t *TopK) AddN(key string, n int64) {
+	t.add(TopKEntry{Key: key, Count: n})
+}
+
+func (t *TopK) add(e TopKEntry) {
+	if entry, ok := t.counts[e.Key]; ok {
+		entry.Count += e.Count
+		entry.Error += e.Error
+		return
+	}
+
+	if len(t.counts) < t.capacity {
+		t.counts[e.Key] = &e
+		return
+	}
+	if len(t.counts) == 0 {
+		return
+	}
+
+	// Replace the least frequent key
+	var min *TopKEntry
+	for _, entry := range t.counts {
+		if min == nil || entry.Count < min.Count {
+			min = entry
+		}
+	}
+	delete(t.counts, min.Key)
+	t.counts[e.Key] = &TopKEntry{Key: e.Key, Count: min.Count + e.Count, Error: min.Count + e.Error}
+}
+
+// Merge adds the counts of other, the result has the error of both
+func (t *TopK) Merge(other *TopK) {
+	for _, entry := range other.counts {
+		t.add(*entry)
+	}
+}
+
+// Top returns up to n of the most frequent keys, most frequent first
+func (t *TopK) Top(n int) []TopKEntry {
+	entries := make([]TopKEntry, 0, len(t.counts))
+	for _, entry := range t.counts {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// Entries returns every tracked key so the counter can be saved and restored with Load
+func (t *TopK) Entries() []TopKEntry {
+	return t.Top(t.capacity)
+}
+
+// Load replaces the tracked keys with entries
+func (t *TopK) Load(entries []TopKEntry) {
+	t.counts = make(map[string]*TopKEntry, t.capacity)
+	for i := range entries {
+		if len(t.counts) >= t.capacity {
+			break
+		}
+		entry := entries[i]
+		t.counts[entry.Key] = &entry
+	}
+}
+
+type topKJSON struct {
+	Capacity int         `json:"capacity"`
+	Entries  []TopKEntry `json:"entries"`
+}
+
+func (t *TopK) MarshalJSON() ([]byte, error) {
+	return json.Marshal(topKJSON{Capacity: t.capacity, Entries: t.Entries()})
+}
+
+func (t *TopK) UnmarshalJSON(data []byte) error {
+	var v topKJSON
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	t.capacity = v.Capacity
+	if t.capacity < len(v.Entries) {
+		t.capacity = len(v.Entries)
+	}
+	t.Load(v.Entries)
+	return nil
+}
+
+// Copy returns an independent copy
+func (t *TopK) Copy() *TopK {
+	c := NewTopK(t.capacity)
+	c.Load(t.Entries())
+	return c
+}
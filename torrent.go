@@ -1,13 +1,19 @@
 package main
 
 import (
-	"io"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/fs"
-	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -15,8 +21,13 @@ import (
 	"github.com/gocolly/colly"
 )
 
+// torrentRunning is true while torrents are being scraped and synced
+var torrentRunning atomic.Bool
+
 // HandleTorrents periodically downloads remote torrents and extracts torrents from disk
-func HandleTorrents(config *ConfigFile, torrentDir, downloadDir string) {
+// manual starts a run immediately. Sending on stop cancels the current run, waits for it to return and then responds on stop
+// runNow starts a run right away, it is false when the scheduler is restarted after a reload
+func HandleTorrents(config *ConfigFile, torrentDir, downloadDir string, manual <-chan struct{}, stop chan struct{}, runNow bool) {
 	err := os.MkdirAll(downloadDir, 0755)
 	if err != nil {
 		logging.Error("Failed to create torrents downloadDir: ", err)
@@ -29,80 +40,380 @@ func HandleTorrents(config *ConfigFile, torrentDir, downloadDir string) {
 		return
 	}
 
-	// On startup, and then every day at midnight
+	// Stopping the scheduler cancels the run in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs sync.WaitGroup
+	start := func() {
+		runs.Add(1)
+		go func() {
+			defer runs.Done()
+			runTorrents(ctx, config, torrentDir, downloadDir)
+		}()
+	}
+
+	// On startup, then config.TorrentSyncsPerDay times a day starting at midnight
 	// - scrape torrents from upstreams (such as linuxmint)
 	// - search disk for torrent files and corresponding downloads
 	// - sync downloadDir
 	// - sync torrentDir
-	go scrapeTorrents(config.Torrents, torrentDir)
-	go syncTorrents(config, torrentDir, downloadDir)
+	// - add new torrents to transmission and remove the ones deleted upstream
+	if runNow {
+		start()
+	}
+
+	sleep := time.Until(nextTorrentRun(time.Now(), config.TorrentSyncsPerDay))
+	timer := time.NewTimer(sleep)
+	logging.Success("Torrent scheduler started, next run in", sleep)
+
+	for {
+		select {
+		case <-stop:
+			logging.Info("Torrent scheduler stopping...")
+			timer.Stop()
+
+			// Cancel the current run and wait for it to return
+			cancel()
+			runs.Wait()
+
+			// Respond to the stop signal
+			stop <- struct{}{}
+			return
+		case <-timer.C:
+			timer.Reset(time.Until(nextTorrentRun(time.Now(), config.TorrentSyncsPerDay)))
+			start()
+		case <-manual:
+			start()
+		}
+	}
+}
+
+// nextTorrentRun returns the first of perDay evenly spaced times starting at midnight that is after now
+func nextTorrentRun(now time.Time, perDay int) time.Time {
+	if perDay < 1 {
+		perDay = 1
+	}
+	interval := 24 * time.Hour / time.Duration(perDay)
+
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for !next.After(now) {
+		next = next.Add(interval)
+	}
+	return next
+}
 
-	// Sleep until midnight
-	now := time.Now()
-	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.Local)
-	time.Sleep(time.Until(midnight))
-	go scrapeTorrents(config.Torrents, torrentDir)
-	go syncTorrents(config, torrentDir, downloadDir)
+// runTorrents scrapes the upstreams and then syncs the projects' torrents, unless a run is already going
+// The run stops early once ctx is cancelled
+func runTorrents(ctx context.Context, config *ConfigFile, torrentDir, downloadDir string) {
+	if !torrentRunning.CompareAndSwap(false, true) {
+		logging.Info("Torrents are already being synced, skipping this run")
+		return
+	}
+	defer torrentRunning.Store(false)
 
-	ticker := time.NewTicker(24 * time.Hour)
-	for range ticker.C {
-		go scrapeTorrents(config.Torrents, torrentDir)
-		go syncTorrents(config, torrentDir, downloadDir)
+	scrapeTorrents(ctx, config.Torrents, torrentDir)
+	if ctx.Err() != nil {
+		logging.Info("Torrent run cancelled")
+		return
 	}
+	syncTorrents(ctx, config, torrentDir, downloadDir)
+}
+
+// torrentManifest is the file in the download directory that torrentProjects is saved to
+const torrentManifest = ".torrents.json"
+
+// torrentSyncLock keeps two runs of syncTorrents from adding the same torrents
+var torrentSyncLock sync.Mutex
+
+// torrentSource is a torrent file found in a project's tree
+type torrentSource struct {
+	project string
+	path    string
+	hash    string
+	// found is false when the file the torrent shares is missing from the project's tree
+	found bool
+	// generated is true for torrents we made from the file, its pieces were hashed while making it
+	generated bool
+}
+
+// TorrentSyncReport is what a run of syncTorrents changed
+type TorrentSyncReport struct {
+	Added   []string
+	Removed []string
+	// Mismatched are the torrents skipped because their file doesn't match, with the reason
+	Mismatched []string
 }
 
 // syncTorrents goes over all projects, finds their torrent files, the corresponding source
 // files and then creates hardlinks in the download and torrent directories
-func syncTorrents(config *ConfigFile, torrentDir, ourDir string) {
+// New torrents are added to transmission and torrents whose source file was deleted upstream are removed along with their hardlinks
+// Nothing is added or removed if ctx is cancelled while the projects are searched
+func syncTorrents(ctx context.Context, config *ConfigFile, torrentDir, ourDir string) (report TorrentSyncReport) {
+	torrentSyncLock.Lock()
+	defer torrentSyncLock.Unlock()
+
+	loadTorrentManifest(ourDir)
+
+	// Projects whose glob found nothing aren't reconciled, their disk may be missing or mid sync
+	sources := make(map[string]torrentSource)
+	searched := make(map[string]bool)
 	for _, project := range config.GetProjects() {
 		if project.Torrents == "" {
 			continue
 		}
 
-		go func(project Project) {
-			// Find all torrent files using glob
-			matches, err := filepath.Glob(project.Torrents + "*.torrent")
+		// Find all torrent files using glob
+		matches, err := filepath.Glob(project.Torrents + "*.torrent")
+		if err != nil {
+			logging.Error("Failed to find torrent files: ", err)
+			continue
+		}
+		searched[project.Short] = len(matches) > 0
 
-			if err != nil {
-				logging.Error("Failed to find torrent files: ", err)
-				return
+		for _, torrentPath := range matches {
+			fileName := strings.TrimSuffix(path.Base(torrentPath), ".torrent")
+			source := torrentSource{project: project.Short, path: torrentPath}
+
+			// Search the glob for the corresponding file
+			files, _ := filepath.Glob(project.Torrents + fileName)
+			sources[fileName] = addSource(ctx, source, files, ourDir, fileName, &report)
+		}
+	}
+
+	// Torrents are generated for the files of projects that don't publish their own
+	for _, project := range config.GetProjects() {
+		if project.TorrentGenerate == "" {
+			continue
+		}
+
+		generated := generateTorrents(ctx, project, config.TorrentGenerator, ourDir)
+		searched[project.Short] = searched[project.Short] || len(generated) > 0
+		for torrentPath, file := range generated {
+			fileName := path.Base(file)
+			if _, ok := sources[fileName]; ok {
+				continue
+			}
+
+			source := torrentSource{project: project.Short, path: torrentPath, generated: true}
+			sources[fileName] = addSource(ctx, source, []string{file}, ourDir, fileName, &report)
+		}
+	}
+
+	// An interrupted search would look like every torrent after it was deleted upstream
+	if ctx.Err() != nil {
+		logging.Info("Torrent sync cancelled")
+		return TorrentSyncReport{}
+	}
+
+	sort.Strings(report.Mismatched)
+	if len(report.Mismatched) > 0 {
+		logging.WarnToDiscord(fmt.Sprintf("%d torrents don't match their files and were skipped\n%s", len(report.Mismatched), strings.Join(report.Mismatched, "\n")))
+	}
+
+	var loaded []TransmissionTorrent
+	var err error
+	if transmission == nil {
+		err = errors.New("transmission is not configured")
+	} else {
+		loaded, err = transmission.Torrents()
+	}
+	if err != nil {
+		// Without the daemon fall back to its watch dir and leave removals for the next run
+		logging.Warn("Failed to list torrents, they will only be linked into", torrentDir, err)
+		for _, source := range sources {
+			if source.found {
+				linkTorrent(source.path, torrentDir)
 			}
+		}
+		return report
+	}
+
+	byName := make(map[string]TransmissionTorrent, len(loaded))
+	byHash := make(map[string]TransmissionTorrent, len(loaded))
+	for _, torrent := range loaded {
+		byName[torrent.Name] = torrent
+		byHash[torrent.HashString] = torrent
+	}
 
-			for _, torrentPath := range matches {
-				fileName := strings.TrimSuffix(path.Base(torrentPath), ".torrent")
-				addFile(project, ourDir, fileName)
+	torrentProjectsLock.Lock()
+	defer torrentProjectsLock.Unlock()
 
-				// Add the torrent file _after_ copying the actual file
-				// This should skip the verification step
-				torrentName := path.Base(torrentPath)
-				_, err = os.Stat(torrentDir + "/" + torrentName)
+	// Add the torrent _after_ linking the actual file into the download dir so transmission only verifies it
+	for name, source := range sources {
+		if !source.found {
+			continue
+		}
+
+		torrent, ok := byHash[source.hash]
+		if !ok {
+			// A torrent of the same name with another hash was made for an older version of the file
+			if old, found := byName[name]; found {
+				err = transmission.RemoveTorrents(old.ID)
 				if err != nil {
-					if os.IsNotExist(err) {
-						// Create a hardlink
-						err = os.Link(torrentPath, torrentDir+"/"+torrentName)
-						if err != nil {
-							logging.Warn("Failed to create hardlink: ", err)
-							continue
-						}
-					} else {
-						logging.Error("Failed to stat a torrent file: ", err)
-					}
+					logging.Warn("Failed to remove the old torrent of", name, err)
+					continue
 				}
+				report.Removed = append(report.Removed, name)
+			}
+
+			torrent, err = transmission.AddTorrent(source.path, ourDir)
+			if err != nil {
+				logging.Warn("Failed to add torrent", source.path, err)
+				continue
 			}
-		}(project)
+			report.Added = append(report.Added, name)
+		}
+
+		torrentProjects[name] = managedTorrent{
+			Project: source.project,
+			Hash:    torrent.HashString,
+			Torrent: path.Base(source.path),
+			File:    name,
+		}
+		linkTorrent(source.path, torrentDir)
+	}
+
+	// Remove the torrents whose file is gone from their project
+	for name, managed := range torrentProjects {
+		if source, ok := sources[name]; ok && source.found {
+			continue
+		}
+		if !searched[managed.Project] {
+			continue
+		}
+
+		torrent, ok := byHash[managed.Hash]
+		if !ok {
+			torrent, ok = byName[name]
+		}
+		if ok {
+			err = transmission.RemoveTorrents(torrent.ID)
+			if err != nil {
+				logging.Warn("Failed to remove torrent", name, err)
+				continue
+			}
+		}
+
+		for _, link := range []string{ourDir + "/" + managed.File, torrentDir + "/" + managed.Torrent} {
+			err = os.Remove(link)
+			if err != nil && !os.IsNotExist(err) {
+				logging.Warn("Failed to remove hardlink: ", err)
+			}
+		}
+		delete(torrentProjects, name)
+		report.Removed = append(report.Removed, name)
+	}
+
+	err = saveTorrentManifest(ourDir)
+	if err != nil {
+		logging.Warn("Failed to save", torrentManifest, err)
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+	if len(report.Added) > 0 || len(report.Removed) > 0 {
+		logging.InfoToDiscord(fmt.Sprintf("Torrents synced: %d added %v, %d removed %v", len(report.Added), report.Added, len(report.Removed), report.Removed))
+	} else {
+		logging.Info("Torrents synced: nothing added or removed")
+	}
+	return report
+}
+
+// addSource links the file of a torrent into the download directory, a torrent that doesn't match its file is added to the report
+func addSource(ctx context.Context, source torrentSource, files []string, downloadDir, fileName string, report *TorrentSyncReport) torrentSource {
+	if ctx.Err() != nil {
+		return source
+	}
+
+	torrent, err := ParseTorrentFile(source.path)
+	if err == nil {
+		source.hash = torrent.InfoHash
+		source.found, err = addFile(ctx, files, downloadDir, fileName, torrent, torrentVerifyPieces && !source.generated)
+	}
+	if err != nil {
+		report.Mismatched = append(report.Mismatched, fileName+": "+err.Error())
+	}
+	return source
+}
+
+// linkTorrent hardlinks a torrent file into torrentDir, which is served as an index of everything we seed
+func linkTorrent(torrentPath, torrentDir string) {
+	torrentName := path.Base(torrentPath)
+	linked, err := os.Stat(torrentDir + "/" + torrentName)
+	if err == nil {
+		// Replace links to an older version of the torrent
+		source, err := os.Stat(torrentPath)
+		if err != nil || os.SameFile(linked, source) {
+			return
+		}
+		err = os.Remove(torrentDir + "/" + torrentName)
+		if err != nil {
+			logging.Warn("Failed to remove hardlink: ", err)
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		logging.Error("Failed to stat a torrent file: ", err)
+		return
+	}
+
+	// Create a hardlink
+	err = os.Link(torrentPath, torrentDir+"/"+torrentName)
+	if err != nil {
+		logging.Warn("Failed to create hardlink: ", err)
 	}
 }
 
-// Fetches a file from a glob and a name. Saves it to downloadDir
-func addFile(project Project, downloadDir, fileName string) {
-	// Search the glob for the corresponding file
-	files, err := filepath.Glob(project.Torrents + fileName)
+// loadTorrentManifest reads the torrents added by previous runs unless they are already known
+func loadTorrentManifest(downloadDir string) {
+	torrentProjectsLock.Lock()
+	defer torrentProjectsLock.Unlock()
+
+	if len(torrentProjects) > 0 {
+		return
+	}
+
+	data, err := os.ReadFile(downloadDir + "/" + torrentManifest)
 	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warn("Failed to read", torrentManifest, err)
+		}
 		return
 	}
 
+	err = json.Unmarshal(data, &torrentProjects)
+	if err != nil {
+		logging.Warn("Failed to parse", torrentManifest, err)
+	}
+}
+
+// saveTorrentManifest writes torrentProjects to the download directory, the caller must hold torrentProjectsLock
+func saveTorrentManifest(downloadDir string) error {
+	data, err := json.MarshalIndent(torrentProjects, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a partial manifest
+	tmp := downloadDir + "/" + torrentManifest + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, downloadDir+"/"+torrentManifest)
+}
+
+// Fetches the file a torrent shares from the files that could be it. Saves it to downloadDir
+// Returns false if the file isn't in the project's tree, and an error if it doesn't match the torrent
+// New files are checked against the torrent before they are linked, files that were already linked only by their size
+// The pieces of new files are only hashed if pieces is true
+func addFile(ctx context.Context, files []string, downloadDir, fileName string, torrent *TorrentInfo, pieces bool) (bool, error) {
+	if torrent.Name != fileName {
+		return false, fmt.Errorf("the torrent shares %q", torrent.Name)
+	}
+
 	if len(files) == 0 {
-		return
+		return false, nil
 	}
 
 	// In case there are multiple files, pick the first one that correctly resolves to a file
@@ -122,12 +433,15 @@ func addFile(project Project, downloadDir, fileName string) {
 		file = f
 		break
 	}
+	if file == "" {
+		return false, nil
+	}
 
 	// Get ownership information of the download directory
 	info, err := os.Stat(downloadDir)
 	if err != nil {
 		logging.Warn("Failed to stat downloadDir: ", err)
-		return
+		return true, nil
 	}
 
 	// gid is that of the downloadDir
@@ -139,51 +453,147 @@ func addFile(project Project, downloadDir, fileName string) {
 
 	// Check if the file is already in the download directory
 	_, err = os.Stat(downloadDir + "/" + fileName)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// Create a hardlink
-			err = os.Link(file, downloadDir+"/"+fileName)
-			if err != nil {
-				logging.Warn("Failed to create hardlink: ", err)
+	if err == nil {
+		// The link can't be seeded if it no longer matches, it is linked again once upstream fixes the file
+		err = torrent.VerifyFile(ctx, downloadDir+"/"+fileName, false)
+		if err != nil {
+			removeErr := os.Remove(downloadDir + "/" + fileName)
+			if removeErr != nil {
+				logging.Warn("Failed to remove hardlink: ", removeErr)
 			}
+			return false, err
+		}
+	} else if os.IsNotExist(err) {
+		// A half synced file would be rejected by peers
+		err = torrent.VerifyFile(ctx, file, pieces)
+		if err != nil {
+			return false, err
+		}
 
-			err = os.Chown(downloadDir+"/"+fileName, uid, gid)
-			if err != nil {
-				logging.Warn("Failed to chown file: ", err)
-			}
+		// Create a hardlink
+		err = os.Link(file, downloadDir+"/"+fileName)
+		if err != nil {
+			logging.Warn("Failed to create hardlink: ", err)
+		}
 
-			// Make the file group writable
-			err = os.Chmod(downloadDir+"/"+fileName, fs.FileMode(0775))
-			if err != nil {
-				logging.Warn("Failed to chmod file: ", err)
-			}
-		} else {
-			logging.Error("Failed to stat a torrent file: ", err)
+		err = os.Chown(downloadDir+"/"+fileName, uid, gid)
+		if err != nil {
+			logging.Warn("Failed to chown file: ", err)
+		}
+
+		// Make the file group writable
+		err = os.Chmod(downloadDir+"/"+fileName, fs.FileMode(0775))
+		if err != nil {
+			logging.Warn("Failed to chmod file: ", err)
 		}
+	} else {
+		logging.Error("Failed to stat a torrent file: ", err)
 	}
 
+	return true, nil
+}
+
+// Limits of the scraper, a torrent file of an ISO is a few hundred KiB
+const (
+	scrapeTimeout      = 30 * time.Second
+	scrapeMaxBodySize  = 10 * 1024 * 1024
+	scrapeUserAgent    = "COSI-Lab/Mirror torrent scraper (+https://mirror.clarkson.edu)"
+	torrentContentType = "application/x-bittorrent"
+)
+
+// ScrapeReport is the outcome of scraping an upstream
+type ScrapeReport struct {
+	Url string
+	// Torrent links found, and of those the ones downloaded, already on disk or that failed to download
+	Found      int
+	Downloaded int
+	Skipped    int
+	Failed     int
+	// Blocked are the torrent links robots.txt doesn't allow us to visit
+	Blocked int
+	// Err is set if the upstream itself couldn't be visited
+	Err error
+}
+
+func (report ScrapeReport) String() string {
+	s := fmt.Sprintf("%s: %d found, %d downloaded, %d already downloaded, %d failed, %d blocked by robots.txt", report.Url, report.Found, report.Downloaded, report.Skipped, report.Failed, report.Blocked)
+	if report.Err != nil {
+		s += ", " + report.Err.Error()
+	}
+	return s
 }
 
-// scrapeTorrents downloads all torrents from upstreams
-func scrapeTorrents(torrents []*Torrent, downloadDir string) {
-	for _, upstream := range torrents {
-		go scrape(upstream.Depth, upstream.Delay, upstream.Url, downloadDir)
+// scrapeTorrents downloads all torrents from upstreams and reports the outcome of each
+func scrapeTorrents(ctx context.Context, torrents []*Torrent, downloadDir string) []ScrapeReport {
+	reports := make([]ScrapeReport, len(torrents))
+
+	var wg sync.WaitGroup
+	for i, upstream := range torrents {
+		wg.Add(1)
+		go func(i int, upstream *Torrent) {
+			defer wg.Done()
+			reports[i] = scrape(ctx, upstream.Depth, upstream.Delay, upstream.Url, downloadDir)
+		}(i, upstream)
+	}
+	wg.Wait()
+
+	// Failures are worth a look, quiet runs only go to the log
+	summary := make([]string, 0, len(reports)+1)
+	total := ScrapeReport{Url: fmt.Sprintf("%d upstreams", len(reports))}
+	failed := false
+	for _, report := range reports {
+		summary = append(summary, report.String())
+		total.Found += report.Found
+		total.Downloaded += report.Downloaded
+		total.Skipped += report.Skipped
+		total.Failed += report.Failed
+		total.Blocked += report.Blocked
+		if report.Failed > 0 || report.Err != nil {
+			failed = true
+		}
+	}
+	summary = append(summary, total.String())
+
+	if failed {
+		logging.WarnToDiscord("Torrent scrape finished with failures\n" + strings.Join(summary, "\n"))
+	} else if len(reports) > 0 {
+		logging.Info("Torrent scrape finished\n" + strings.Join(summary, "\n"))
 	}
+
+	return reports
+}
+
+// isTorrentURL is true if u links to a .torrent file
+func isTorrentURL(u *url.URL) bool {
+	return strings.HasSuffix(u.Path, ".torrent")
 }
 
 // Visits a url and downloads all torrents to outdir
 //
-// Torrents with a name that already exists are skipped if
-// the upstream file has the same file size as the one on disk
-func scrape(depth, delay int, url, outdir string) {
-	logging.Info("Scraping " + url)
+// Only pages on the same host as url are visited and robots.txt is respected
+// Torrents with a name that already exists are skipped, no more requests are made once ctx is cancelled
+func scrape(ctx context.Context, depth, delay int, upstream, outdir string) (report ScrapeReport) {
+	logging.Info("Scraping " + upstream)
+	report.Url = upstream
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		report.Err = err
+		return report
+	}
 
 	// Instantiate default collector
 	c := colly.NewCollector(
 		// MaxDepth is 1, so only the links on the scraped page
 		// is visited, and no further links are followed
-		colly.MaxDepth(depth + 1),
+		colly.MaxDepth(depth+1),
+		// colly compares against the host including its port
+		colly.AllowedDomains(u.Hostname(), u.Host),
+		colly.UserAgent(scrapeUserAgent),
+		colly.MaxBodySize(scrapeMaxBodySize),
 	)
+	c.IgnoreRobotsTxt = false
+	c.SetRequestTimeout(scrapeTimeout)
 
 	c.Limit(&colly.LimitRule{
 		DomainGlob: "*",
@@ -192,53 +602,82 @@ func scrape(depth, delay int, url, outdir string) {
 
 	// On every a element which has href attribute call callback
 	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		link := e.Attr("href")
+		link := e.Request.AbsoluteURL(e.Attr("href"))
 
-		// Visit link found on page
-		e.Request.Visit(link)
+		// Visit link found on page, links to other sites are ignored
+		err := e.Request.Visit(link)
+		if err == colly.ErrRobotsTxtBlocked {
+			if linkURL, err := url.Parse(link); err == nil && isTorrentURL(linkURL) {
+				report.Blocked++
+			}
+		}
 	})
 
-	// Before making a request print "Visiting ..."
 	c.OnRequest(func(r *colly.Request) {
-		pos := strings.LastIndex(r.URL.Path, ".")
-		if pos != -1 && r.URL.Path[pos+1:len(r.URL.Path)] == "torrent" {
-			// Check if we already have this file by name
-			name := path.Base(r.URL.Path)
-			file := outdir + "/" + name
-			_, err := os.Stat(file)
+		if ctx.Err() != nil {
+			r.Abort()
+			return
+		}
+		if !isTorrentURL(r.URL) {
+			return
+		}
+		report.Found++
+
+		// Check if we already have this file by name
+		_, err := os.Stat(outdir + "/" + path.Base(r.URL.Path))
+		if err == nil {
+			report.Skipped++
+			r.Abort()
+		} else if !os.IsNotExist(err) {
+			// Unrecoverable error
+			logging.Warn(err)
+			report.Failed++
+			r.Abort()
+		}
+	})
 
-			if err != nil {
-				if os.IsNotExist(err) {
-					// Download
-					download(r, file)
-				} else {
-					// Unrecoverable error
-					logging.Warn(err)
-				}
-			}
+	c.OnResponse(func(r *colly.Response) {
+		if !isTorrentURL(r.Request.URL) {
+			return
+		}
+
+		err := saveTorrent(r, outdir+"/"+path.Base(r.Request.URL.Path))
+		if err != nil {
+			logging.Warn("Failed to download", r.Request.URL, err)
+			report.Failed++
+		} else {
+			report.Downloaded++
 		}
 	})
 
-	c.Visit(url)
-	logging.Success("Finished scraping " + url)
-}
+	c.OnError(func(r *colly.Response, err error) {
+		if isTorrentURL(r.Request.URL) {
+			logging.Warn("Failed to download", r.Request.URL, err)
+			report.Failed++
+		}
+	})
 
-// Downloads the file at `r` and saves it to `target` on disk
-func download(r *colly.Request, target string) error {
-	res, err := http.Get(r.URL.String())
-	if err != nil {
-		return err
+	report.Err = c.Visit(upstream)
+	if report.Err == nil {
+		logging.Success("Finished scraping " + upstream)
 	}
+	return report
+}
 
-	f, err := os.Create(target)
-	if err != nil {
-		return err
+// saveTorrent checks that a response is a torrent and saves it to target
+// It is written to a temporary file first so a failed download never leaves a truncated torrent
+func saveTorrent(r *colly.Response, target string) error {
+	// Error pages are often served with 200
+	contentType := r.Headers.Get("Content-Type")
+	if strings.HasPrefix(contentType, "text/html") {
+		return fmt.Errorf("expected %s but got %s", torrentContentType, contentType)
 	}
 
-	_, err = io.Copy(f, res.Body)
+	// colly silently truncates bodies larger than MaxBodySize, that is caught here as well
+	_, err := ParseTorrent(r.Body)
 	if err != nil {
 		return err
 	}
 
-	return res.Body.Close()
+	return writeFileAtomic(target, r.Body)
 }
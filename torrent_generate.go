@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/COSI-Lab/logging"
+)
+
+// Torrents are generated for projects that set torrent_generate, as v1 torrents or v1 and v2 hybrids
+// http://bittorrent.org/beps/bep_0003.html
+// http://bittorrent.org/beps/bep_0052.html
+// Web seeds point at our HTTP mirror so clients can download from us before there are any peers
+// http://bittorrent.org/beps/bep_0019.html
+
+// TorrentGenerator is the torrent_generator section of the config
+type TorrentGenerator struct {
+	Trackers []string `json:"trackers"`
+	// Files under Root are served at URL
+	Root string `json:"root"`
+	URL  string `json:"url"`
+	// Hybrid torrents also have the v2 file tree and piece layers
+	Hybrid bool `json:"hybrid"`
+	// PieceLength is picked from the file size if it is 0
+	PieceLength int64 `json:"piece_length"`
+}
+
+// torrentBlockSize is the size of the leaves of the v2 merkle trees and the smallest piece length
+const torrentBlockSize = 16 * 1024
+
+// generatedTorrentDir is the directory in DOWNLOAD_DIR generated torrents are kept in
+const generatedTorrentDir = ".generated"
+
+// generatedTorrent is an entry of the cache of generated torrents
+type generatedTorrent struct {
+	Size    int64            `json:"size"`
+	ModTime time.Time        `json:"mod_time"`
+	Torrent string           `json:"torrent"`
+	Config  TorrentGenerator `json:"config"`
+}
+
+// generatedTorrentsLock guards the cache file
+var generatedTorrentsLock sync.Mutex
+
+// webSeed returns the URL file is served at or "" if it isn't under the root
+func (g *TorrentGenerator) webSeed(file string) string {
+	if g.Root == "" || g.URL == "" {
+		return ""
+	}
+
+	rel, err := filepath.Rel(g.Root, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return ""
+	}
+
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.TrimSuffix(g.URL, "/") + "/" + strings.Join(segments, "/")
+}
+
+// pieceLength picks a piece length so the torrent has around 1000 to 2000 pieces
+func (g *TorrentGenerator) pieceLength(size int64) int64 {
+	if g.PieceLength != 0 {
+		return g.PieceLength
+	}
+
+	length := int64(256 * 1024)
+	for size/length > 2000 && length < 16*1024*1024 {
+		length *= 2
+	}
+	return length
+}
+
+// generateTorrents creates a torrent for every file matching the project's torrent_generate glob
+// Returns the files by the path of their torrent. Torrents are only recreated if their file or the generator settings changed
+func generateTorrents(ctx context.Context, project Project, generator TorrentGenerator, downloadDir string) map[string]string {
+	matches, err := filepath.Glob(project.TorrentGenerate)
+	if err != nil {
+		logging.Error("Failed to find files to generate torrents for: ", err)
+		return nil
+	}
+
+	dir := filepath.Join(downloadDir, generatedTorrentDir, project.Short)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		logging.Error("Failed to create the generated torrents directory: ", err)
+		return nil
+	}
+
+	generatedTorrentsLock.Lock()
+	defer generatedTorrentsLock.Unlock()
+
+	cacheFile := filepath.Join(dir, "cache.json")
+	cache := make(map[string]generatedTorrent)
+	data, err := os.ReadFile(cacheFile)
+	if err == nil {
+		err = json.Unmarshal(data, &cache)
+		if err != nil {
+			logging.Warn("Failed to parse", cacheFile, err)
+		}
+	}
+
+	torrents := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, file := range matches {
+		// The cache is still saved so the torrents made so far aren't hashed again
+		if ctx.Err() != nil {
+			break
+		}
+
+		info, err := os.Lstat(file)
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 || strings.HasSuffix(file, ".torrent") {
+			continue
+		}
+		seen[file] = true
+
+		cached, ok := cache[file]
+		if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) && sameGenerator(cached.Config, generator) {
+			if _, err := os.Stat(cached.Torrent); err == nil {
+				torrents[cached.Torrent] = file
+				continue
+			}
+		}
+
+		logging.Info("Generating a torrent for", file)
+		metainfo, err := generator.Generate(ctx, file)
+		if err != nil {
+			logging.Warn("Failed to generate a torrent for", file, err)
+			continue
+		}
+
+		torrentPath := filepath.Join(dir, path.Base(file)+".torrent")
+		err = writeFileAtomic(torrentPath, metainfo)
+		if err != nil {
+			logging.Warn("Failed to save the torrent of", file, err)
+			continue
+		}
+
+		cache[file] = generatedTorrent{Size: info.Size(), ModTime: info.ModTime(), Torrent: torrentPath, Config: generator}
+		torrents[torrentPath] = file
+	}
+
+	// Forget files that are gone, syncTorrents removes them from transmission
+	// A cancelled run hasn't seen every file
+	for file, cached := range cache {
+		if !seen[file] && ctx.Err() == nil {
+			os.Remove(cached.Torrent)
+			delete(cache, file)
+		}
+	}
+
+	data, err = json.MarshalIndent(cache, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(cacheFile, data)
+	}
+	if err != nil {
+		logging.Warn("Failed to save", cacheFile, err)
+	}
+
+	return torrents
+}
+
+// sameGenerator is true if torrents made with a and b are the same
+func sameGenerator(a, b TorrentGenerator) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+// writeFileAtomic writes to a temporary file first so a crash can't leave a partial file
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	err := os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Generate hashes file and returns the bencoded torrent of it, or ctx's error if it is cancelled first
+func (g *TorrentGenerator) Generate(ctx context.Context, file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size == 0 {
+		return nil, errors.New("empty files can't be shared")
+	}
+	pieceLength := g.pieceLength(size)
+
+	// Both versions are hashed in one pass. v1 hashes each piece with sha1,
+	// v2 hashes each 16KiB block with sha256 and builds a merkle tree over each piece
+	var pieces []byte
+	var layer [][][]byte
+	var blocks [][]byte
+	v1 := sha1.New()
+	block := make([]byte, torrentBlockSize)
+	r := bufio.NewReaderSize(f, 1024*1024)
+	var read int64
+	for read < size {
+		n, err := io.ReadFull(r, block)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		read += int64(n)
+
+		v1.Write(block[:n])
+		if g.Hybrid {
+			leaf := sha256.Sum256(block[:n])
+			blocks = append(blocks, leaf[:])
+		}
+
+		if read%pieceLength == 0 || read == size {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			pieces = v1.Sum(pieces)
+			v1.Reset()
+
+			if g.Hybrid {
+				layer = append(layer, blocks)
+				blocks = nil
+			}
+		}
+	}
+	if read != size {
+		return nil, errors.New("the file changed while it was hashed")
+	}
+
+	name := path.Base(file)
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+		"length":       size,
+	}
+	metainfo := map[string]interface{}{
+		"created by":    "COSI-Lab/Mirror",
+		"creation date": time.Now().Unix(),
+	}
+
+	if g.Hybrid {
+		root, pieceLayer := merkleFile(layer, pieceLength)
+		info["meta version"] = 2
+		info["file tree"] = map[string]interface{}{
+			name: map[string]interface{}{
+				"": map[string]interface{}{
+					"length":      size,
+					"pieces root": root,
+				},
+			},
+		}
+
+		// Files that fit in a single piece have no piece layer
+		layers := make(map[string]interface{})
+		if size > pieceLength {
+			layers[string(root)] = pieceLayer
+		}
+		metainfo["piece layers"] = layers
+	}
+
+	metainfo["info"] = info
+
+	if len(g.Trackers) > 0 {
+		metainfo["announce"] = g.Trackers[0]
+
+		// Each tracker is its own tier so clients announce to all of them
+		tiers := make([]interface{}, 0, len(g.Trackers))
+		for _, tracker := range g.Trackers {
+			tiers = append(tiers, []string{tracker})
+		}
+		metainfo["announce-list"] = tiers
+	}
+
+	if seed := g.webSeed(file); seed != "" {
+		metainfo["url-list"] = []string{seed}
+	}
+
+	return EncodeBencode(metainfo)
+}
+
+// merkleFile returns the v2 pieces root of a file and its piece layer from the block hashes of each piece
+func merkleFile(pieces [][][]byte, pieceLength int64) (root []byte, layer []byte) {
+	blocksPerPiece := int(pieceLength / torrentBlockSize)
+
+	// A file in a single piece is one tree padded to a power of two blocks
+	if len(pieces) == 1 {
+		return merkleRoot(pieces[0], nextPowerOfTwo(len(pieces[0])), make([]byte, sha256.Size)), nil
+	}
+
+	zero := make([]byte, sha256.Size)
+	hashes := make([][]byte, 0, len(pieces))
+	for _, blocks := range pieces {
+		hash := merkleRoot(blocks, blocksPerPiece, zero)
+		hashes = append(hashes, hash)
+		layer = append(layer, hash...)
+	}
+
+	// Pieces past the end of the file are made of zero blocks
+	padding := merkleRoot(nil, blocksPerPiece, zero)
+	return merkleRoot(hashes, nextPowerOfTwo(len(hashes)), padding), layer
+}
+
+// merkleRoot hashes leaves padded with pad up to width, which must be a power of two
+func merkleRoot(leaves [][]byte, width int, pad []byte) []byte {
+	level := make([][]byte, width)
+	for i := range level {
+		if i < len(leaves) {
+			level[i] = leaves[i]
+		} else {
+			level[i] = pad
+		}
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			hash := sha256.Sum256(append(append([]byte{}, level[2*i]...), level[2*i+1]...))
+			next[i] = hash[:]
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testMetainfo is a torrent with a comment of the given length
+func testMetainfo(comment int) string {
+	return fmt.Sprintf("d7:comment%d:%s4:infod6:lengthi1e4:name4:test12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee", comment, strings.Repeat("x", comment))
+}
+
+// serveTorrent responds with body as a torrent
+func serveTorrent(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", torrentContentType)
+		w.Write([]byte(body))
+	}
+}
+
+func TestScrape(t *testing.T) {
+	// Links to other hosts must never be visited
+	var offHostHits atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offHostHits.Add(1)
+		serveTorrent(testMetainfo(0))(w, r)
+	}))
+	t.Cleanup(other.Close)
+
+	var blockedHits atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	mux.HandleFunc("/releases/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<html><body>
+			<a href="good.torrent">good</a>
+			<a href="error.torrent">error</a>
+			<a href="big.torrent">big</a>
+			<a href="truncated.torrent">truncated</a>
+			<a href="existing.torrent">existing</a>
+			<a href="/private/blocked.torrent">blocked</a>
+			<a href="%s/offhost.torrent">off host</a>
+		</body></html>`, other.URL)
+	})
+	mux.HandleFunc("/releases/good.torrent", serveTorrent(testMetainfo(0)))
+	mux.HandleFunc("/releases/existing.torrent", serveTorrent(testMetainfo(0)))
+	// Mirrors commonly answer a missing file with an error page and 200
+	mux.HandleFunc("/releases/error.torrent", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>Not Found</body></html>")
+	})
+	// colly cuts the body off at scrapeMaxBodySize
+	mux.HandleFunc("/releases/big.torrent", serveTorrent(testMetainfo(scrapeMaxBodySize)))
+	// The connection is closed before the promised length is sent
+	mux.HandleFunc("/releases/truncated.torrent", func(w http.ResponseWriter, r *http.Request) {
+		body := testMetainfo(0)
+		w.Header().Set("Content-Type", torrentContentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)*2))
+		w.Write([]byte(body))
+	})
+	mux.HandleFunc("/private/blocked.torrent", func(w http.ResponseWriter, r *http.Request) {
+		blockedHits.Add(1)
+		serveTorrent(testMetainfo(0))(w, r)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	outdir := t.TempDir()
+	err := os.WriteFile(filepath.Join(outdir, "existing.torrent"), []byte(testMetainfo(0)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := scrape(context.Background(), 1, 0, server.URL+"/releases/", outdir)
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	want := ScrapeReport{Url: server.URL + "/releases/", Found: 5, Downloaded: 1, Skipped: 1, Failed: 3, Blocked: 1}
+	if report != want {
+		t.Errorf("got %v, want %v", report, want)
+	}
+	if offHostHits.Load() != 0 {
+		t.Errorf("the off host torrent was requested %d times", offHostHits.Load())
+	}
+	if blockedHits.Load() != 0 {
+		t.Errorf("the torrent disallowed by robots.txt was requested %d times", blockedHits.Load())
+	}
+
+	// Rejected downloads leave nothing behind, not even a temporary file
+	entries, err := os.ReadDir(outdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "existing.torrent,good.torrent" {
+		t.Errorf("outdir has %v", names)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outdir, "good.torrent"))
+	if err != nil || string(data) != testMetainfo(0) {
+		t.Errorf("good.torrent is %q, %v", data, err)
+	}
+}
+
+func TestScrapeCancelled(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Robots.txt is fetched before the request is made, the page itself must not be
+	report := scrape(ctx, 1, 0, server.URL+"/releases/", t.TempDir())
+	if report.Found != 0 || report.Downloaded != 0 {
+		t.Errorf("got %v", report)
+	}
+	if hits.Load() > 1 {
+		t.Errorf("got %d requests after the scrape was cancelled", hits.Load())
+	}
+}
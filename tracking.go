@@ -2,64 +2,77 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"net"
-	"os"
-	"os/exec"
-	"strconv"
+	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/COSI-Lab/logging"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
 )
 
 type NetStat struct {
-	BytesSent int64
-	BytesRecv int64
-	Requests  int64
+	BytesSent int64 `json:"bytesSent"`
+	BytesRecv int64 `json:"bytesRecv"`
+	Requests  int64 `json:"requests"`
 }
 type DistroStatistics map[string]*NetStat
+
+// StatusClasses counts HTTP responses by the class of their status code
+type StatusClasses struct {
+	Status2xx int64 `json:"2xx"`
+	Status3xx int64 `json:"3xx"`
+	Status4xx int64 `json:"4xx"`
+	Status5xx int64 `json:"5xx"`
+}
+type StatusStatistics map[string]*StatusClasses
 type TransmissionStatistics struct {
-	Uploaded   int64
-	Downloaded int64
-	Torrents   int
-	Ratio      float64
+	Uploaded   int64   `json:"uploaded"`
+	Downloaded int64   `json:"downloaded"`
+	Torrents   int     `json:"torrents"`
+	Ratio      float64 `json:"ratio"`
+	// Bytes uploaded by the torrents of each project that are currently seeded
+	Projects map[string]int64 `json:"projects,omitempty"`
 }
 type Statistics struct {
 	sync.RWMutex
-	nginx        DistroStatistics
-	clarkson     DistroStatistics
-	transmission TransmissionStatistics
-	rsyncd       NetStat
+	nginx DistroStatistics
+	// traffic from each of networkGroups
+	networks      NetworkStatistics
+	networkGroups []*NetworkGroup
+	transmission  TransmissionStatistics
+	// rsync traffic of each module, modules are named after projects
+	rsyncd   DistroStatistics
+	statuses StatusStatistics
+	// most requested paths that returned 404 for each project
+	notFound  map[string]*TopK
+	geo       GeoStatistics
+	agents    AgentStatistics
+	crawlers  *CrawlerWatch
+	downloads DownloadStatistics
+	// position of the last counted entry of each log, saved so counting resumes there after a restart
+	cursors map[string]LogCursor
 }
 
+// notFoundTracked is how many different 404 paths are counted for each project
+// and notFoundShown is how many of them are exported and shown on the stats page
+const notFoundTracked = 100
+const notFoundShown = 10
+
 var statistics Statistics
-var clarksonIPv4net *net.IPNet
-var clarksonIPv6net *net.IPNet
 
-// Prepare filters and regular expressions
-func init() {
-	var err error
-	_, clarksonIPv4net, err = net.ParseCIDR("128.153.0.0/16")
-	if err != nil {
-		logging.Panic(err)
-		os.Exit(1)
-	}
-	_, clarksonIPv6net, err = net.ParseCIDR("2605:6480::/32")
-	if err != nil {
-		logging.Panic(err)
-		os.Exit(1)
-	}
-}
+// statsStore is where statistics are loaded from at startup and saved to every minute
+var statsStore StatsStore
 
 // HandleStatistics receives parsed log entries over channels and tracks the useful information
 // The statistics object should be created before this function can be run.
 func HandleStatistics(nginxEntries chan *NginxLogEntry, rsyncdEntries chan *RsyncdLogEntry) {
-	// We send the latest stats to influxdb every minute
+	// We save the latest stats every minute
 	ticker := time.NewTicker(1 * time.Minute)
 
 	for {
@@ -86,237 +99,273 @@ func HandleStatistics(nginxEntries chan *NginxLogEntry, rsyncdEntries chan *Rsyn
 			statistics.nginx["total"].BytesRecv += entry.BytesRecv
 			statistics.nginx["total"].Requests++
 
-			// Additionally track usage from within the clarkson network
-			if clarksonIPv4net.Contains(entry.IP) || clarksonIPv6net.Contains(entry.IP) {
-				if _, ok := statistics.clarkson[entry.Distro]; ok {
-					statistics.clarkson[entry.Distro].BytesSent += entry.BytesSent
-					statistics.clarkson[entry.Distro].BytesRecv += entry.BytesRecv
-					statistics.clarkson[entry.Distro].Requests++
+			// Track responses by status class
+			if classes, ok := statistics.statuses[entry.Distro]; ok {
+				classes.Add(entry.Status)
+			} else {
+				statistics.statuses["other"].Add(entry.Status)
+			}
+			statistics.statuses["total"].Add(entry.Status)
+
+			// Where the traffic of each project comes from
+			if geo, ok := statistics.geo[entry.Distro]; ok {
+				geo.Add(entry)
+			}
+			statistics.geo["total"].Add(entry)
+
+			// The most popular files
+			if downloads, ok := statistics.downloads[entry.Distro]; ok {
+				downloads.Add(entry)
+			}
+			statistics.downloads["total"].Add(entry)
+
+			// A spike of 404s for a project usually means its sync is broken
+			if entry.Status == http.StatusNotFound {
+				if notFound, ok := statistics.notFound[entry.Distro]; ok {
+					path, _, _ := strings.Cut(entry.Url, "?")
+					notFound.Add(path)
+				}
+			}
+
+			// Additionally track usage from within each configured network
+			for _, group := range statistics.networkGroups {
+				if !group.Contains(entry.IP) {
+					continue
+				}
+				network := statistics.networks[group.Name]
+				if _, ok := network[entry.Distro]; ok {
+					network[entry.Distro].BytesSent += entry.BytesSent
+					network[entry.Distro].BytesRecv += entry.BytesRecv
+					network[entry.Distro].Requests++
 				} else {
-					statistics.clarkson["other"].BytesSent += entry.BytesSent
-					statistics.clarkson["other"].BytesRecv += entry.BytesRecv
-					statistics.clarkson["other"].Requests++
+					network["other"].BytesSent += entry.BytesSent
+					network["other"].BytesRecv += entry.BytesRecv
+					network["other"].Requests++
 				}
-				statistics.clarkson["total"].BytesSent += entry.BytesSent
-				statistics.clarkson["total"].BytesRecv += entry.BytesRecv
-				statistics.clarkson["total"].Requests++
+				network["total"].BytesSent += entry.BytesSent
+				network["total"].BytesRecv += entry.BytesRecv
+				network["total"].Requests++
+			}
+
+			// Track which kinds of clients use each project
+			class, name := agentClassifier.Classify(entry.Agent)
+			if _, ok := statistics.agents[entry.Distro]; ok {
+				statistics.agents.Add(entry.Distro, class)
+			} else {
+				statistics.agents.Add("other", class)
+			}
+			statistics.agents.Add("total", class)
+
+			if !entry.Cursor.Time.IsZero() {
+				statistics.cursors["nginx"] = entry.Cursor
+			}
+
+			abusive := false
+			if class == agentCrawler {
+				abusive = statistics.crawlers.Add(name, entry.Time, agentClassifier.rules.AbusiveRequestsPerHour)
 			}
 			statistics.Unlock()
+
+			// Only warn about recent hours, not ones replayed from old logs at startup
+			if abusive && time.Since(entry.Time) < 2*time.Hour {
+				logging.WarnToDiscord(fmt.Sprintf("Crawler %q made more than %d requests in the hour starting %s", name, agentClassifier.rules.AbusiveRequestsPerHour, entry.Time.Truncate(time.Hour).Format(time.RFC3339)))
+			}
 		case entry := <-rsyncdEntries:
 			statistics.Lock()
-			statistics.rsyncd.BytesSent += entry.sent
-			statistics.rsyncd.BytesRecv += entry.recv
-			statistics.rsyncd.Requests++
+			if _, ok := statistics.rsyncd[entry.module]; ok {
+				statistics.rsyncd[entry.module].BytesSent += entry.sent
+				statistics.rsyncd[entry.module].BytesRecv += entry.recv
+				statistics.rsyncd[entry.module].Requests++
+			} else {
+				statistics.rsyncd["other"].BytesSent += entry.sent
+				statistics.rsyncd["other"].BytesRecv += entry.recv
+				statistics.rsyncd["other"].Requests++
+			}
+			statistics.rsyncd["total"].BytesSent += entry.sent
+			statistics.rsyncd["total"].BytesRecv += entry.recv
+			statistics.rsyncd["total"].Requests++
+			if !entry.cursor.Time.IsZero() {
+				statistics.cursors["rsyncd"] = entry.cursor
+			}
 			statistics.Unlock()
 		}
 	}
 }
 
-// Start a command and allow it to cancel after a certain amount of time
-func runCommand(cmd *exec.Cmd, d time.Duration) error {
-	cmd.Start()
-
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
-
-	select {
-	case <-time.After(d):
-		if err := cmd.Process.Kill(); err != nil {
-			return err
-		}
-		return errors.New("transmission-remote timed out")
-	case err := <-done:
-		if err != nil {
-			return err
-		}
+// Add counts a response with the given status code
+func (c *StatusClasses) Add(status int) {
+	switch status / 100 {
+	case 2:
+		c.Status2xx++
+	case 3:
+		c.Status3xx++
+	case 4:
+		c.Status4xx++
+	case 5:
+		c.Status5xx++
 	}
-
-	return nil
 }
 
-// Get the latest statistics from Transmission
-func SetTransmissionStatistics() error {
-	// Get the count by running transmission-remote -l
-	// The output is in the form of a table, so we can just count the lines - 2 for the head and tail
-	cmd := exec.Command("transmission-remote", "-ne", "-l")
-	cmd.Env = append(os.Environ(), "TR_AUTH=transmission:")
+// Total is the number of responses counted
+func (c StatusClasses) Total() int64 {
+	return c.Status2xx + c.Status3xx + c.Status4xx + c.Status5xx
+}
 
-	err := runCommand(cmd, 5*time.Second)
-	if err != nil {
-		return err
+// ErrorRate is the fraction of responses that were 4xx or 5xx
+func (c StatusClasses) ErrorRate() float64 {
+	total := c.Total()
+	if total == 0 {
+		return 0
 	}
+	return float64(c.Status4xx+c.Status5xx) / float64(total)
+}
 
-	out, err := cmd.Output()
-	if err != nil {
-		return err
+// BytesToHumanReadableSize formats a number of bytes with SI units
+//
+// Examples:
+//
+//	1000 -> "1.0 KB"
+//	1500000 -> "1.5 MB"
+func BytesToHumanReadableSize(size int64) string {
+	const units = "KMGTPE"
+	if size < 1000 {
+		return fmt.Sprintf("%d B", size)
 	}
 
-	lines := strings.Split(string(out), "\n")
-	torrents := len(lines) - 2
-
-	// Get the total upload and download by running transmission-remote -st
-	cmd = exec.Command("transmission-remote", "-ne", "-st")
-	cmd.Env = append(os.Environ(), "TR_AUTH=transmission:")
+	value := float64(size)
+	i := -1
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", value, units[i])
+}
 
-	err = runCommand(cmd, 5*time.Second)
-	if err != nil {
-		return err
+// Sends the latest statistics to the store
+func Sendstatistics() {
+	if statsStore == nil {
+		return
 	}
 
-	out, err = cmd.Output()
+	err := statsStore.Save(snapshotStatistics())
 	if err != nil {
-		return err
+		logging.Error("Failed to save statistics", err)
+		return
 	}
 
-	// Get the TOTAL uploaded, downloaded and ratio
-	lines = strings.Split(string(out), "\n")
-	uploaded := strings.Split(lines[9], ":")[1]
-	downloaded := strings.Split(lines[10], ":")[1]
-	ratio := strings.Split(lines[11], ":")[1]
+	logging.Info("Sent statistics")
+}
 
-	// Convert the human readable sizes to bytes
-	uploadedBytes, err := HumanReadableSizeToBytes(uploaded)
-	if err != nil {
-		return err
-	}
-	downloadedBytes, err := HumanReadableSizeToBytes(downloaded)
-	if err != nil {
-		return err
-	}
+// snapshotStatistics copies the current statistics
+func snapshotStatistics() StatsSnapshot {
+	statistics.RLock()
+	defer statistics.RUnlock()
 
-	ratioFloat, err := strconv.ParseFloat(strings.TrimSpace(ratio), 64)
-	if err != nil {
-		return err
+	notFound := make(map[string][]TopKEntry, len(statistics.notFound))
+	for short, topk := range statistics.notFound {
+		notFound[short] = topk.Entries()
 	}
 
-	// Set the statistics
-	statistics.Lock()
-	statistics.transmission.Torrents = torrents
-	statistics.transmission.Uploaded = uploadedBytes
-	statistics.transmission.Downloaded = downloadedBytes
-	statistics.transmission.Ratio = ratioFloat
-	statistics.Unlock()
-
-	return nil
+	return StatsSnapshot{
+		Time:         time.Now(),
+		Nginx:        copyDistroStatistics(statistics.nginx),
+		Networks:     copyNetworkStatistics(statistics.networks),
+		Transmission: copyTransmissionStatistics(statistics.transmission),
+		Rsyncd:       copyDistroStatistics(statistics.rsyncd),
+		Statuses:     copyStatusStatistics(statistics.statuses),
+		NotFound:     notFound,
+		Geo:          copyGeoStatistics(statistics.geo),
+		Agents:       copyAgentStatistics(statistics.agents),
+		Downloads:    copyDownloadStatistics(statistics.downloads),
+		Cursors:      copyLogCursors(statistics.cursors),
+	}
 }
 
-// HumanReadableSizeToBytes converts a human readable size to bytes
-//
-// Examples:
-//
-//	"1.0 KB" -> 1000
-//	"1.0   MB" -> 1000000
-//	"1.0 GB" -> 1000000000
-func HumanReadableSizeToBytes(size string) (int64, error) {
-	// Get the size and unit
-	size = strings.TrimSpace(size)
-	unit := size[len(size)-2:]
-	size = size[:len(size)-2]
-
-	// Convert the size to an int
-	sizeFloat, err := strconv.ParseFloat(strings.TrimSpace(size), 64)
-	if err != nil {
-		return 0, err
+// newDistroStatistics creates zeroed counters for every project, "other" and "total"
+func newDistroStatistics(projects map[string]*Project) DistroStatistics {
+	stats := make(DistroStatistics)
+	for short := range projects {
+		stats[short] = &NetStat{}
 	}
+	stats["other"] = &NetStat{}
+	stats["total"] = &NetStat{}
+	return stats
+}
 
-	// Convert the unit to bytes
-	switch unit {
-	case "KB":
-		return int64(sizeFloat * 1000), nil
-	case "MB":
-		return int64(sizeFloat * 1000 * 1000), nil
-	case "GB":
-		return int64(sizeFloat * 1000 * 1000 * 1000), nil
-	case "TB":
-		return int64(sizeFloat * 1000 * 1000 * 1000 * 1000), nil
-	case "PB":
-		return int64(sizeFloat * 1000 * 1000 * 1000 * 1000 * 1000), nil
-	default:
-		return 0, fmt.Errorf("Unknown unit %s", unit)
+// mergeDistroStatistics creates counters for every project starting from the saved values
+// Saved distros that are no longer projects are dropped
+func mergeDistroStatistics(projects map[string]*Project, saved DistroStatistics) DistroStatistics {
+	stats := newDistroStatistics(projects)
+	for distro, stat := range saved {
+		if _, ok := stats[distro]; ok && stat != nil {
+			*stats[distro] = *stat
+		}
 	}
+	return stats
 }
 
-// Sends the latest statistics to the database
-func Sendstatistics() {
-	if influxReadOnly {
-		logging.Info("INFLUX_READ_ONLY is set, not sending data to influx")
-		return
+// mergeStatusStatistics is mergeDistroStatistics for status classes
+func mergeStatusStatistics(projects map[string]*Project, saved StatusStatistics) StatusStatistics {
+	stats := make(StatusStatistics)
+	for short := range projects {
+		stats[short] = &StatusClasses{}
 	}
+	stats["other"] = &StatusClasses{}
+	stats["total"] = &StatusClasses{}
 
-	t := time.Now()
-
-	statistics.RLock()
-	for short, stat := range statistics.nginx {
-		p := influxdb2.NewPoint("nginx",
-			map[string]string{"distro": short},
-			map[string]interface{}{
-				"bytes_sent": stat.BytesSent,
-				"bytes_recv": stat.BytesRecv,
-				"requests":   stat.Requests,
-			}, t)
-		writer.WritePoint(p)
-	}
-	for short, stat := range statistics.clarkson {
-		p := influxdb2.NewPoint("clarkson",
-			map[string]string{"distro": short},
-			map[string]interface{}{
-				"bytes_sent": stat.BytesSent,
-				"bytes_recv": stat.BytesRecv,
-				"requests":   stat.Requests,
-			}, t)
-		writer.WritePoint(p)
+	for distro, classes := range saved {
+		if _, ok := stats[distro]; ok && classes != nil {
+			*stats[distro] = *classes
+		}
 	}
-	p := influxdb2.NewPoint("transmission", map[string]string{}, map[string]interface{}{
-		"downloaded": statistics.transmission.Downloaded,
-		"uploaded":   statistics.transmission.Uploaded,
-		"torrents":   statistics.transmission.Torrents,
-		"ratio":      statistics.transmission.Ratio,
-	}, t)
-	writer.WritePoint(p)
-	p = influxdb2.NewPoint("rsyncd", map[string]string{}, map[string]interface{}{
-		"bytes_sent": statistics.rsyncd.BytesSent,
-		"bytes_recv": statistics.rsyncd.BytesRecv,
-		"requests":   statistics.rsyncd.Requests,
-	}, t)
-	writer.WritePoint(p)
-
-	// To be safe we release the lock before logging because logging takes a seperate lock
-	statistics.RUnlock()
-
-	logging.Info("Sent statistics")
+	return stats
 }
 
-// InitStatistics queries the database for the all of the latest statistics
+// InitStatistics loads the latest statistics from the store
 // In general everything in `statistics` should be monotonically increasing
-// lastUpdated should be the same no matter where we check
-func InitStatistics(projects map[string]*Project) (lastUpdated time.Time, err error) {
-	// Map from short names to bytes sent
-	statistics = Statistics{}
-
-	lastUpdated, statistics.nginx, err = QueryDistroStatistics(projects, "nginx")
+// The returned cursors are where each log should be read from, entries before them have already been counted
+func InitStatistics(store StatsStore, projects map[string]*Project, networks []*NetworkGroup) (cursors map[string]LogCursor, err error) {
+	snapshot, err := store.Load(projects, networks)
 	if err != nil {
-		return lastUpdated, err
+		return nil, err
 	}
-	lastUpdated, statistics.clarkson, err = QueryDistroStatistics(projects, "clarkson")
-	if err != nil {
-		return lastUpdated, err
+
+	// Statistics saved without a cursor can only be resumed from the time they were saved
+	cursors = copyLogCursors(snapshot.Cursors)
+	for _, log := range []string{"nginx", "rsyncd"} {
+		if _, ok := cursors[log]; !ok {
+			cursors[log] = LogCursor{Time: snapshot.Time}
+		}
 	}
 
-	statistics.rsyncd, err = QueryRsyncdStatistics()
-	if err != nil {
-		return lastUpdated, err
+	statistics.Lock()
+	statistics.nginx = mergeDistroStatistics(projects, snapshot.Nginx)
+	statistics.networks = mergeNetworkStatistics(projects, networks, snapshot.Networks)
+	statistics.networkGroups = networks
+	statistics.transmission = snapshot.Transmission
+	statistics.rsyncd = mergeDistroStatistics(projects, snapshot.Rsyncd)
+	statistics.statuses = mergeStatusStatistics(projects, snapshot.Statuses)
+	statistics.geo = newGeoStatistics(projects, snapshot.Geo)
+	statistics.agents = mergeAgentStatistics(projects, snapshot.Agents)
+	statistics.crawlers = NewCrawlerWatch()
+	statistics.downloads = newDownloadStatistics(projects, snapshot.Downloads)
+	statistics.notFound = make(map[string]*TopK, len(projects))
+	for short := range projects {
+		statistics.notFound[short] = NewTopK(notFoundTracked)
+		statistics.notFound[short].Load(snapshot.NotFound[short])
 	}
+	statistics.cursors = copyLogCursors(cursors)
+	statistics.Unlock()
 
-	return lastUpdated, nil
+	statsStore = store
+	return cursors, nil
 }
 
 // measurement is the particular filter you want `DistroStatistics` from
-// current "clarkson" and "nginx" (all) are supported
-func QueryDistroStatistics(projects map[string]*Project, measurement string) (lastUpdated time.Time, stats DistroStatistics, err error) {
+// current "nginx" (all), "rsync" and the name of each network group are supported
+func QueryDistroStatistics(reader api.QueryAPI, projects map[string]*Project, measurement string) (lastUpdated time.Time, stats DistroStatistics, err error) {
 	// You can paste this into the influxdb data explorer
-	// Replace MEASUREMENT with "nginx" or "clarkson"
+	// Replace MEASUREMENT with "nginx" or a network such as "clarkson"
 	/*
 		from(bucket: "stats")
 		    |> range(start: 0, stop: now())
@@ -325,7 +374,7 @@ func QueryDistroStatistics(projects map[string]*Project, measurement string) (la
 		    |> last()
 		    |> group(columns: ["distro"], mode: "by")
 	*/
-	request := fmt.Sprintf("from(bucket: \"stats\") |> range(start: 0, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"%s\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\" or r[\"_field\"] == \"bytes_recv\" or r[\"_field\"] == \"requests\") |> last() |> group(columns: [\"distro\"], mode: \"by\")", measurement)
+	request := fmt.Sprintf("from(bucket: \"%s\") |> range(start: 0, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"%s\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\" or r[\"_field\"] == \"bytes_recv\" or r[\"_field\"] == \"requests\") |> last() |> group(columns: [\"distro\"], mode: \"by\")", influxBucket, measurement)
 
 	// try the query at most 5 times
 	var result *api.QueryTableResult
@@ -346,12 +395,7 @@ func QueryDistroStatistics(projects map[string]*Project, measurement string) (la
 		return lastUpdated, stats, errors.New("Error querying influxdb")
 	}
 
-	stats = make(DistroStatistics)
-	for short := range projects {
-		stats[short] = &NetStat{}
-	}
-	stats["other"] = &NetStat{}
-	stats["total"] = &NetStat{}
+	stats = newDistroStatistics(projects)
 
 	for result.Next() {
 		if result.Err() == nil {
@@ -417,7 +461,8 @@ func QueryDistroStatistics(projects map[string]*Project, measurement string) (la
 	return lastUpdated, stats, nil
 }
 
-func QueryRsyncdStatistics() (stat NetStat, err error) {
+// QueryRsyncdStatistics returns the total rsyncd traffic from before it was counted per module
+func QueryRsyncdStatistics(reader api.QueryAPI) (stat NetStat, err error) {
 	// You can paste this into the influxdb data explorer
 	/*
 		from(bucket: "stats")
@@ -426,7 +471,7 @@ func QueryRsyncdStatistics() (stat NetStat, err error) {
 		    |> filter(fn: (r) => r["_field"] == "bytes_sent" or r["_field"] == "bytes_recv" or r["_field"] == "requests")
 		    |> last()
 	*/
-	const request = "from(bucket: \"stats\") |> range(start: 0, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"rsyncd\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\" or r[\"_field\"] == \"bytes_recv\") |> last()"
+	request := fmt.Sprintf("from(bucket: \"%s\") |> range(start: 0, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"rsyncd\") |> filter(fn: (r) => r[\"_field\"] == \"bytes_sent\" or r[\"_field\"] == \"bytes_recv\" or r[\"_field\"] == \"requests\") |> last()", influxBucket)
 
 	// try the query at most 5 times
 	var result *api.QueryTableResult
@@ -469,7 +514,7 @@ func QueryRsyncdStatistics() (stat NetStat, err error) {
 					fmt.Printf("%T %v\n", dp.ValueByKey("_value"), dp.ValueByKey("_value"))
 					continue
 				}
-				statistics.rsyncd.BytesSent = sent
+				stat.BytesSent = sent
 			case "bytes_recv":
 				received, ok := dp.ValueByKey("_value").(int64)
 				if !ok {
@@ -477,7 +522,7 @@ func QueryRsyncdStatistics() (stat NetStat, err error) {
 					fmt.Printf("%T %v\n", dp.ValueByKey("_value"), dp.ValueByKey("_value"))
 					continue
 				}
-				statistics.rsyncd.BytesRecv = received
+				stat.BytesRecv = received
 			case "requests":
 				requests, ok := dp.ValueByKey("_value").(int64)
 				if !ok {
@@ -485,12 +530,372 @@ func QueryRsyncdStatistics() (stat NetStat, err error) {
 					fmt.Printf("%T %v\n", dp.ValueByKey("_value"), dp.ValueByKey("_value"))
 					continue
 				}
-				statistics.rsyncd.Requests = requests
+				stat.Requests = requests
 			}
 		} else {
-			logging.Warn("InitNGINXStats Flux Query Error", result.Err())
+			logging.Warn("QueryRsyncdStatistics Flux Query Error", result.Err())
 		}
 	}
+	result.Close()
 
 	return stat, nil
 }
+
+// queryLatest calls each with the latest value of every series in a measurement
+func queryLatest(reader api.QueryAPI, measurement string, each func(record *query.FluxRecord)) (err error) {
+	// You can paste this into the influxdb data explorer
+	// Replace MEASUREMENT with "status" or "agents"
+	/*
+		from(bucket: "stats")
+		    |> range(start: 0, stop: now())
+		    |> filter(fn: (r) => r["_measurement"] == "MEASUREMENT")
+		    |> last()
+	*/
+	request := fmt.Sprintf("from(bucket: \"%s\") |> range(start: 0, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"%s\") |> last()", influxBucket, measurement)
+	return queryRecords(reader, measurement, request, each)
+}
+
+// queryRecords runs a flux query, retrying if it fails, and calls each for every record
+func queryRecords(reader api.QueryAPI, measurement, request string, each func(record *query.FluxRecord)) (err error) {
+	// try the query at most 5 times
+	var result *api.QueryTableResult
+	for i := 0; i < 5; i++ {
+		result, err = reader.Query(context.Background(), request)
+
+		if err != nil {
+			logging.Warn("Failed to querying influxdb", measurement, "statistics", err)
+			// Sleep for some time before retrying
+			time.Sleep(time.Duration(i) * time.Second)
+			continue
+		}
+
+		break
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error querying influxdb for %s statistics", measurement)
+	}
+
+	for result.Next() {
+		if result.Err() != nil {
+			logging.Warn("queryRecords Flux Query Error", result.Err())
+			continue
+		}
+		each(result.Record())
+	}
+	result.Close()
+
+	return nil
+}
+
+// QueryStatusStatistics gets the latest status class counters of every distro
+func QueryStatusStatistics(reader api.QueryAPI) (stats StatusStatistics, err error) {
+	stats = make(StatusStatistics)
+	err = queryLatest(reader, "status", func(dp *query.FluxRecord) {
+		distro, ok := dp.ValueByKey("distro").(string)
+		if !ok {
+			return
+		}
+		value, ok := dp.ValueByKey("_value").(int64)
+		if !ok {
+			return
+		}
+
+		if stats[distro] == nil {
+			stats[distro] = &StatusClasses{}
+		}
+		switch dp.Field() {
+		case "2xx":
+			stats[distro].Status2xx = value
+		case "3xx":
+			stats[distro].Status3xx = value
+		case "4xx":
+			stats[distro].Status4xx = value
+		case "5xx":
+			stats[distro].Status5xx = value
+		}
+	})
+	return stats, err
+}
+
+// QueryAgentStatistics gets the latest agent class counters of every distro
+func QueryAgentStatistics(reader api.QueryAPI) (stats AgentStatistics, err error) {
+	stats = make(AgentStatistics)
+	err = queryLatest(reader, "agents", func(dp *query.FluxRecord) {
+		distro, ok := dp.ValueByKey("distro").(string)
+		if !ok {
+			return
+		}
+		class, ok := dp.ValueByKey("class").(string)
+		if !ok {
+			return
+		}
+		value, ok := dp.ValueByKey("_value").(int64)
+		if !ok {
+			return
+		}
+
+		if stats[distro] == nil {
+			stats[distro] = make(map[string]int64)
+		}
+		stats[distro][class] = value
+	})
+	return stats, err
+}
+
+// QueryNotFoundStatistics gets the most recently saved top 404 paths of every distro
+// Only the top notFoundShown paths are saved so the rest of each TopK starts over
+func QueryNotFoundStatistics(reader api.QueryAPI) (stats map[string][]TopKEntry, err error) {
+	type ranked struct {
+		time  time.Time
+		entry TopKEntry
+	}
+	latest := make(map[string]time.Time)
+	ranks := make(map[string]map[string]*ranked)
+	err = queryLatest(reader, "not_found", func(dp *query.FluxRecord) {
+		distro, ok := dp.ValueByKey("distro").(string)
+		if !ok {
+			return
+		}
+		rank, ok := dp.ValueByKey("rank").(string)
+		if !ok {
+			return
+		}
+
+		if ranks[distro] == nil {
+			ranks[distro] = make(map[string]*ranked)
+		}
+		r := ranks[distro][rank]
+		if r == nil {
+			r = &ranked{time: dp.Time()}
+			ranks[distro][rank] = r
+		}
+		switch dp.Field() {
+		case "path":
+			r.entry.Key, _ = dp.Value().(string)
+		case "requests":
+			r.entry.Count, _ = dp.Value().(int64)
+		}
+		if dp.Time().After(latest[distro]) {
+			latest[distro] = dp.Time()
+		}
+	})
+
+	// A rank that wasn't in the last save is left over from when the project had more 404 paths
+	stats = make(map[string][]TopKEntry)
+	for distro, entries := range ranks {
+		for _, r := range entries {
+			if r.time.Equal(latest[distro]) && r.entry.Key != "" {
+				stats[distro] = append(stats[distro], r.entry)
+			}
+		}
+	}
+	return stats, err
+}
+
+// QueryGeoStatistics rebuilds the last geoDays days of geographic statistics from the last point of each day
+// Visitors can only be estimated again on days their registers were saved
+func QueryGeoStatistics(reader api.QueryAPI) (stats GeoStatistics, err error) {
+	// You can paste this into the influxdb data explorer
+	/*
+		from(bucket: "stats")
+		    |> range(start: 2024-01-01T00:00:00Z, stop: now())
+		    |> filter(fn: (r) => r["_measurement"] == "geo" or r["_measurement"] == "geo_continent" or r["_measurement"] == "visitors")
+		    |> window(every: 1d)
+		    |> last()
+	*/
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-geoDays)
+	request := fmt.Sprintf("from(bucket: \"%s\") |> range(start: %s, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"geo\" or r[\"_measurement\"] == \"geo_continent\" or r[\"_measurement\"] == \"visitors\") |> window(every: 1d) |> last()", influxBucket, start.Format(time.RFC3339))
+
+	days := make(map[string]map[string]*GeoDay)
+	err = queryRecords(reader, "geo", request, func(dp *query.FluxRecord) {
+		distro, ok := dp.ValueByKey("distro").(string)
+		if !ok {
+			return
+		}
+
+		// Points are written with the time they were saved, which is on the day they count
+		date := dp.Time().UTC().Format("2006-01-02")
+		if days[distro] == nil {
+			days[distro] = make(map[string]*GeoDay)
+		}
+		day := days[distro][date]
+		if day == nil {
+			day = newGeoDay(date)
+			days[distro][date] = day
+		}
+
+		var stats map[string]*NetStat
+		var key string
+		switch dp.Measurement() {
+		case "geo":
+			stats = day.Countries
+			key, ok = dp.ValueByKey("country").(string)
+		case "geo_continent":
+			stats = day.Continents
+			key, ok = dp.ValueByKey("continent").(string)
+		case "visitors":
+			if dp.Field() == "registers" {
+				encoded, _ := dp.Value().(string)
+				registers, err := base64.StdEncoding.DecodeString(encoded)
+				if err == nil {
+					day.Visitors.Merge(&HyperLogLog{Registers: registers})
+				}
+			}
+			return
+		}
+		if !ok {
+			return
+		}
+		value, ok := dp.Value().(int64)
+		if !ok {
+			return
+		}
+
+		if stats[key] == nil {
+			stats[key] = &NetStat{}
+		}
+		switch dp.Field() {
+		case "bytes_sent":
+			stats[key].BytesSent = value
+		case "bytes_recv":
+			stats[key].BytesRecv = value
+		case "requests":
+			stats[key].Requests = value
+		}
+	})
+
+	stats = make(GeoStatistics, len(days))
+	for distro, byDate := range days {
+		geo := &ProjectGeo{}
+		for _, day := range byDate {
+			geo.Days = append(geo.Days, day)
+		}
+		sort.Slice(geo.Days, func(i, j int) bool {
+			return geo.Days[i].Date < geo.Days[j].Date
+		})
+		stats[distro] = geo
+	}
+	return stats, err
+}
+
+// QueryDownloadStatistics rebuilds the last downloadDays days of popular downloads from the last point of each day
+// Only the top downloadsSaved paths of each day are saved so the rest of each day starts over
+func QueryDownloadStatistics(reader api.QueryAPI) (stats DownloadStatistics, err error) {
+	// You can paste this into the influxdb data explorer
+	/*
+		from(bucket: "stats")
+		    |> range(start: 2024-01-01T00:00:00Z, stop: now())
+		    |> filter(fn: (r) => r["_measurement"] == "downloads")
+		    |> window(every: 1d)
+		    |> last()
+	*/
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-downloadDays)
+	request := fmt.Sprintf("from(bucket: \"%s\") |> range(start: %s, stop: now()) |> filter(fn: (r) => r[\"_measurement\"] == \"downloads\") |> window(every: 1d) |> last()", influxBucket, start.Format(time.RFC3339))
+
+	type ranked struct {
+		time  time.Time
+		entry TopKEntry
+	}
+	// Ranks by distro, day and then kind and rank
+	days := make(map[string]map[string]map[string]*ranked)
+	latest := make(map[string]time.Time)
+	err = queryRecords(reader, "downloads", request, func(dp *query.FluxRecord) {
+		distro, ok := dp.ValueByKey("distro").(string)
+		if !ok {
+			return
+		}
+		kind, ok := dp.ValueByKey("kind").(string)
+		if !ok {
+			return
+		}
+		rank, ok := dp.ValueByKey("rank").(string)
+		if !ok {
+			return
+		}
+
+		date := dp.Time().UTC().Format("2006-01-02")
+		if days[distro] == nil {
+			days[distro] = make(map[string]map[string]*ranked)
+		}
+		if days[distro][date] == nil {
+			days[distro][date] = make(map[string]*ranked)
+		}
+		r := days[distro][date][kind+"/"+rank]
+		if r == nil {
+			r = &ranked{time: dp.Time()}
+			days[distro][date][kind+"/"+rank] = r
+		}
+		switch dp.Field() {
+		case "path":
+			r.entry.Key, _ = dp.Value().(string)
+		case "count":
+			r.entry.Count, _ = dp.Value().(int64)
+		case "error":
+			r.entry.Error, _ = dp.Value().(int64)
+		}
+		if dp.Time().After(latest[distro+"/"+date]) {
+			latest[distro+"/"+date] = dp.Time()
+		}
+	})
+
+	// A rank that wasn't in the last save of its day is left over from an earlier one
+	stats = make(DownloadStatistics, len(days))
+	for distro, byDate := range days {
+		downloads := &ProjectDownloads{}
+		for date, ranks := range byDate {
+			var requests, bytes []TopKEntry
+			for key, r := range ranks {
+				if !r.time.Equal(latest[distro+"/"+date]) || r.entry.Key == "" {
+					continue
+				}
+				if strings.HasPrefix(key, "requests/") {
+					requests = append(requests, r.entry)
+				} else {
+					bytes = append(bytes, r.entry)
+				}
+			}
+
+			day := &DownloadDay{
+				Date:     date,
+				Requests: NewTopK(downloadsTracked),
+				Bytes:    NewTopK(downloadsTracked),
+			}
+			day.Requests.Load(requests)
+			day.Bytes.Load(bytes)
+			downloads.Days = append(downloads.Days, day)
+		}
+		sort.Slice(downloads.Days, func(i, j int) bool {
+			return downloads.Days[i].Date < downloads.Days[j].Date
+		})
+		stats[distro] = downloads
+	}
+	return stats, err
+}
+
+// QueryLogCursors returns where counting stopped in each log
+func QueryLogCursors(reader api.QueryAPI) (cursors map[string]LogCursor, err error) {
+	cursors = make(map[string]LogCursor)
+	err = queryLatest(reader, "log_cursor", func(dp *query.FluxRecord) {
+		log, ok := dp.ValueByKey("log").(string)
+		if !ok {
+			return
+		}
+		value, ok := dp.ValueByKey("_value").(int64)
+		if !ok {
+			return
+		}
+
+		cursor := cursors[log]
+		switch dp.Field() {
+		case "inode":
+			cursor.Inode = uint64(value)
+		case "offset":
+			cursor.Offset = value
+		case "time":
+			cursor.Time = time.Unix(0, value)
+		}
+		cursors[log] = cursor
+	})
+	return cursors, err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// A client for the Transmission JSON-RPC protocol
+// https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+
+// transmissionSessionHeader is the CSRF token Transmission requires on every request
+const transmissionSessionHeader = "X-Transmission-Session-Id"
+
+// TransmissionClient talks to the RPC endpoint of a Transmission daemon
+type TransmissionClient struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+
+	// The session id is handed out by the first request that is rejected with 409
+	lock      sync.Mutex
+	sessionID string
+}
+
+// transmission is the daemon torrents are seeded with, set at startup from TRANSMISSION_URL
+var transmission *TransmissionClient
+
+func NewTransmissionClient(url, username, password string) *TransmissionClient {
+	return &TransmissionClient{
+		url:      url,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type transmissionRequest struct {
+	Method    string      `json:"method"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string          `json:"result"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// call runs method and decodes its arguments into result
+func (c *TransmissionClient) call(method string, arguments interface{}, result interface{}) error {
+	body, err := json.Marshal(transmissionRequest{Method: method, Arguments: arguments})
+	if err != nil {
+		return err
+	}
+
+	// The first attempt can be rejected because the session id is missing or expired
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.username != "" || c.password != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+		c.lock.Lock()
+		req.Header.Set(transmissionSessionHeader, c.sessionID)
+		c.lock.Unlock()
+
+		res, err := c.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode == http.StatusConflict {
+			res.Body.Close()
+			c.lock.Lock()
+			c.sessionID = res.Header.Get(transmissionSessionHeader)
+			c.lock.Unlock()
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("transmission %s: %s", method, res.Status)
+		}
+
+		var response transmissionResponse
+		err = json.NewDecoder(res.Body).Decode(&response)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("transmission %s: %w", method, err)
+		}
+		if response.Result != "success" {
+			return fmt.Errorf("transmission %s: %s", method, response.Result)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(response.Arguments, result)
+	}
+
+	return fmt.Errorf("transmission %s: no session id was given", method)
+}
+
+// TransmissionSession is the part of session-get we use
+type TransmissionSession struct {
+	Version     string `json:"version"`
+	RPCVersion  int    `json:"rpc-version"`
+	DownloadDir string `json:"download-dir"`
+}
+
+// SessionGet returns the daemon's settings
+func (c *TransmissionClient) SessionGet() (session TransmissionSession, err error) {
+	err = c.call("session-get", map[string][]string{"fields": {"version", "rpc-version", "download-dir"}}, &session)
+	return session, err
+}
+
+// TransmissionStats are the totals of session-stats
+type TransmissionStats struct {
+	UploadedBytes   int64 `json:"uploadedBytes"`
+	DownloadedBytes int64 `json:"downloadedBytes"`
+	FilesAdded      int64 `json:"filesAdded"`
+	SessionCount    int64 `json:"sessionCount"`
+	SecondsActive   int64 `json:"secondsActive"`
+}
+
+// TransmissionSessionStats is the result of session-stats
+type TransmissionSessionStats struct {
+	ActiveTorrentCount int               `json:"activeTorrentCount"`
+	PausedTorrentCount int               `json:"pausedTorrentCount"`
+	TorrentCount       int               `json:"torrentCount"`
+	DownloadSpeed      int64             `json:"downloadSpeed"`
+	UploadSpeed        int64             `json:"uploadSpeed"`
+	Cumulative         TransmissionStats `json:"cumulative-stats"`
+	Current            TransmissionStats `json:"current-stats"`
+}
+
+// SessionStats returns the transfer totals of the daemon, the cumulative stats survive its restarts
+func (c *TransmissionClient) SessionStats() (stats TransmissionSessionStats, err error) {
+	err = c.call("session-stats", nil, &stats)
+	return stats, err
+}
+
+// TransmissionTorrent is a torrent as returned by torrent-get
+type TransmissionTorrent struct {
+	ID             int     `json:"id"`
+	Name           string  `json:"name"`
+	HashString     string  `json:"hashString"`
+	DownloadDir    string  `json:"downloadDir"`
+	Status         int     `json:"status"`
+	Error          int     `json:"error"`
+	ErrorString    string  `json:"errorString"`
+	PercentDone    float64 `json:"percentDone"`
+	TotalSize      int64   `json:"totalSize"`
+	UploadedEver   int64   `json:"uploadedEver"`
+	DownloadedEver int64   `json:"downloadedEver"`
+	UploadRatio    float64 `json:"uploadRatio"`
+	RateUpload     int64   `json:"rateUpload"`
+	PeersConnected int     `json:"peersConnected"`
+}
+
+// transmissionTorrentFields are the fields requested by Torrents, they must match the json tags of TransmissionTorrent
+var transmissionTorrentFields = []string{
+	"id", "name", "hashString", "downloadDir", "status", "error", "errorString", "percentDone",
+	"totalSize", "uploadedEver", "downloadedEver", "uploadRatio", "rateUpload", "peersConnected",
+}
+
+// Torrents returns every torrent loaded in the daemon with its upload statistics
+func (c *TransmissionClient) Torrents() ([]TransmissionTorrent, error) {
+	var result struct {
+		Torrents []TransmissionTorrent `json:"torrents"`
+	}
+	err := c.call("torrent-get", map[string][]string{"fields": transmissionTorrentFields}, &result)
+	return result.Torrents, err
+}
+
+// AddTorrent adds the .torrent file at torrentPath to the daemon with its files in downloadDir
+// When the files are already in downloadDir they are only checked, nothing is downloaded
+// Adding a torrent that is already loaded is not an error, the loaded torrent is returned
+func (c *TransmissionClient) AddTorrent(torrentPath, downloadDir string) (TransmissionTorrent, error) {
+	metainfo, err := os.ReadFile(torrentPath)
+	if err != nil {
+		return TransmissionTorrent{}, err
+	}
+
+	arguments := map[string]interface{}{
+		"metainfo":     base64.StdEncoding.EncodeToString(metainfo),
+		"download-dir": downloadDir,
+		"paused":       false,
+	}
+	var result struct {
+		Added     *TransmissionTorrent `json:"torrent-added"`
+		Duplicate *TransmissionTorrent `json:"torrent-duplicate"`
+	}
+	err = c.call("torrent-add", arguments, &result)
+	if err != nil {
+		return TransmissionTorrent{}, err
+	}
+
+	switch {
+	case result.Added != nil:
+		return *result.Added, nil
+	case result.Duplicate != nil:
+		return *result.Duplicate, nil
+	}
+	return TransmissionTorrent{}, fmt.Errorf("transmission torrent-add: %s was not added", torrentPath)
+}
+
+// RemoveTorrents removes torrents from the daemon, their files are left on disk
+func (c *TransmissionClient) RemoveTorrents(ids ...int) error {
+	arguments := map[string]interface{}{
+		"ids":               ids,
+		"delete-local-data": false,
+	}
+	return c.call("torrent-remove", arguments, nil)
+}
+
+// managedTorrent is a torrent from a project's tree that syncTorrents added to transmission
+type managedTorrent struct {
+	Project string `json:"project"`
+	Hash    string `json:"hash"`
+	// Names of the hardlinks in the torrent and download directories
+	Torrent string `json:"torrent"`
+	File    string `json:"file"`
+}
+
+// torrentProjectsLock guards torrentProjects
+var torrentProjectsLock sync.RWMutex
+
+// torrentProjects maps the name of each torrent found in a project's torrents glob to where it came from
+// It is saved to torrentManifest in the download directory so torrents can be removed after a restart
+var torrentProjects = make(map[string]managedTorrent)
+
+// copyTransmissionStatistics creates a deep copy of stats
+func copyTransmissionStatistics(stats TransmissionStatistics) TransmissionStatistics {
+	c := stats
+	if stats.Projects != nil {
+		c.Projects = make(map[string]int64, len(stats.Projects))
+		for short, uploaded := range stats.Projects {
+			c.Projects[short] = uploaded
+		}
+	}
+	return c
+}
+
+// Get the latest statistics from Transmission
+func SetTransmissionStatistics() error {
+	if transmission == nil {
+		return errors.New("transmission is not configured")
+	}
+
+	stats, err := transmission.SessionStats()
+	if err != nil {
+		return err
+	}
+
+	torrents, err := transmission.Torrents()
+	if err != nil {
+		return err
+	}
+
+	// Attribute seeding to the project each torrent came from, torrents scraped from upstreams are "other"
+	projects := make(map[string]int64)
+	torrentProjectsLock.RLock()
+	for _, torrent := range torrents {
+		short := "other"
+		if managed, ok := torrentProjects[torrent.Name]; ok {
+			short = managed.Project
+		}
+		projects[short] += torrent.UploadedEver
+	}
+	torrentProjectsLock.RUnlock()
+
+	ratio := 0.0
+	if stats.Cumulative.DownloadedBytes > 0 {
+		ratio = float64(stats.Cumulative.UploadedBytes) / float64(stats.Cumulative.DownloadedBytes)
+	}
+
+	// Set the statistics
+	statistics.Lock()
+	statistics.transmission.Torrents = stats.TorrentCount
+	statistics.transmission.Uploaded = stats.Cumulative.UploadedBytes
+	statistics.transmission.Downloaded = stats.Cumulative.DownloadedBytes
+	statistics.transmission.Ratio = ratio
+	statistics.transmission.Projects = projects
+	statistics.Unlock()
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTransmission is a Transmission RPC endpoint that answers each method with a canned response
+type fakeTransmission struct {
+	t *testing.T
+
+	lock      sync.Mutex
+	sessionID string
+	// conflicts counts the requests rejected for a missing or stale session id
+	conflicts int
+	// requests are the arguments of each accepted request by method
+	requests  map[string]json.RawMessage
+	responses map[string]string
+}
+
+func newFakeTransmission(t *testing.T) (*fakeTransmission, *TransmissionClient) {
+	fake := &fakeTransmission{
+		t:         t,
+		sessionID: "first-session",
+		requests:  make(map[string]json.RawMessage),
+		responses: make(map[string]string),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, NewTransmissionClient(server.URL, "transmission", "hunter2")
+}
+
+// conflictCount returns how many requests were rejected with 409
+func (f *fakeTransmission) conflictCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.conflicts
+}
+
+// request returns the arguments of the last request for method
+func (f *fakeTransmission) request(method string) json.RawMessage {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests[method]
+}
+
+func (f *fakeTransmission) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "transmission" || password != "hunter2" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Header.Get(transmissionSessionHeader) != f.sessionID {
+		f.conflicts++
+		w.Header().Set(transmissionSessionHeader, f.sessionID)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	var request struct {
+		Method    string          `json:"method"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		f.t.Errorf("bad request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.requests[request.Method] = request.Arguments
+
+	response, ok := f.responses[request.Method]
+	if !ok {
+		f.t.Errorf("unexpected method %s", request.Method)
+		response = `{"result": "method name not recognized", "arguments": {}}`
+	}
+	w.Write([]byte(response))
+}
+
+func TestTransmissionSessionHandshake(t *testing.T) {
+	fake, client := newFakeTransmission(t)
+	fake.responses["session-get"] = `{"result": "success", "arguments": {"version": "4.0.5 (a6fe2a64aa)", "rpc-version": 17, "download-dir": "/storage/torrents"}}`
+
+	// The first request has no session id and is retried with the one from the 409
+	session, err := client.SessionGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.RPCVersion != 17 || session.DownloadDir != "/storage/torrents" {
+		t.Errorf("got %+v", session)
+	}
+	if fake.conflictCount() != 1 {
+		t.Errorf("got %d conflicts, want 1", fake.conflictCount())
+	}
+
+	// The id is kept for later requests
+	_, err = client.SessionGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.conflictCount() != 1 {
+		t.Errorf("got %d conflicts after reusing the session id, want 1", fake.conflictCount())
+	}
+
+	// A restarted daemon hands out a new id
+	fake.lock.Lock()
+	fake.sessionID = "second-session"
+	fake.lock.Unlock()
+	_, err = client.SessionGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.conflictCount() != 2 {
+		t.Errorf("got %d conflicts after the session expired, want 2", fake.conflictCount())
+	}
+}
+
+func TestTransmissionSessionStats(t *testing.T) {
+	fake, client := newFakeTransmission(t)
+	fake.responses["session-stats"] = `{"result": "success", "arguments": {
+		"activeTorrentCount": 3, "pausedTorrentCount": 1, "torrentCount": 4, "downloadSpeed": 0, "uploadSpeed": 52428800,
+		"cumulative-stats": {"uploadedBytes": 9007199254740993, "downloadedBytes": 1099511627776, "filesAdded": 40, "sessionCount": 7, "secondsActive": 31536000},
+		"current-stats": {"uploadedBytes": 1073741824, "downloadedBytes": 0, "filesAdded": 2, "sessionCount": 1, "secondsActive": 3600}
+	}}`
+
+	stats, err := client.SessionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TorrentCount != 4 || stats.ActiveTorrentCount != 3 || stats.UploadSpeed != 52428800 {
+		t.Errorf("got %+v", stats)
+	}
+	// Totals above 2^53 must not go through a float64
+	if stats.Cumulative.UploadedBytes != 9007199254740993 || stats.Cumulative.DownloadedBytes != 1099511627776 {
+		t.Errorf("got cumulative %+v", stats.Cumulative)
+	}
+	if stats.Current.UploadedBytes != 1073741824 || stats.Current.SecondsActive != 3600 {
+		t.Errorf("got current %+v", stats.Current)
+	}
+}
+
+func TestTransmissionTorrents(t *testing.T) {
+	fake, client := newFakeTransmission(t)
+	fake.responses["torrent-get"] = `{"result": "success", "arguments": {"torrents": [
+		{"id": 1, "name": "archlinux-2024.01.01-x86_64.iso", "hashString": "2a1b8e8c3e0f4e6c1d2b3a4f5e6d7c8b9a0f1e2d", "downloadDir": "/storage/torrents", "status": 6, "percentDone": 1, "totalSize": 1048576000, "uploadedEver": 5242880000, "uploadRatio": 5.0, "peersConnected": 12},
+		{"id": 2, "name": "debian-12.4.0-amd64-netinst.iso", "hashString": "1f2e3d4c5b6a79880f1e2d3c4b5a69788f9e0d1c", "downloadDir": "/storage/torrents", "status": 0, "error": 3, "errorString": "No data found!", "percentDone": 0.5}
+	]}}`
+
+	torrents, err := client.Torrents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrents) != 2 {
+		t.Fatalf("got %d torrents", len(torrents))
+	}
+	if torrents[0].Name != "archlinux-2024.01.01-x86_64.iso" || torrents[0].UploadedEver != 5242880000 || torrents[0].PeersConnected != 12 {
+		t.Errorf("got %+v", torrents[0])
+	}
+	if torrents[1].Error != 3 || torrents[1].ErrorString != "No data found!" || torrents[1].PercentDone != 0.5 {
+		t.Errorf("got %+v", torrents[1])
+	}
+
+	// Every field of TransmissionTorrent is asked for
+	var arguments struct {
+		Fields []string `json:"fields"`
+	}
+	json.Unmarshal(fake.request("torrent-get"), &arguments)
+	if strings.Join(arguments.Fields, ",") != strings.Join(transmissionTorrentFields, ",") {
+		t.Errorf("requested fields %v", arguments.Fields)
+	}
+}
+
+func TestTransmissionAddDuplicate(t *testing.T) {
+	fake, client := newFakeTransmission(t)
+	fake.responses["torrent-add"] = `{"result": "success", "arguments": {"torrent-duplicate": {"id": 7, "name": "archlinux-2024.01.01-x86_64.iso", "hashString": "2a1b8e8c3e0f4e6c1d2b3a4f5e6d7c8b9a0f1e2d"}}}`
+
+	torrentPath := filepath.Join(t.TempDir(), "archlinux-2024.01.01-x86_64.iso.torrent")
+	metainfo := []byte("d4:infod6:lengthi1e4:name4:test12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee")
+	err := os.WriteFile(torrentPath, metainfo, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := client.AddTorrent(torrentPath, "/storage/torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.ID != 7 || torrent.HashString != "2a1b8e8c3e0f4e6c1d2b3a4f5e6d7c8b9a0f1e2d" {
+		t.Errorf("got %+v", torrent)
+	}
+
+	var arguments struct {
+		Metainfo    string `json:"metainfo"`
+		DownloadDir string `json:"download-dir"`
+	}
+	json.Unmarshal(fake.request("torrent-add"), &arguments)
+	sent, _ := base64.StdEncoding.DecodeString(arguments.Metainfo)
+	if string(sent) != string(metainfo) || arguments.DownloadDir != "/storage/torrents" {
+		t.Errorf("sent %q to %q", sent, arguments.DownloadDir)
+	}
+}
+
+func TestTransmissionFailure(t *testing.T) {
+	fake, client := newFakeTransmission(t)
+	fake.responses["torrent-remove"] = `{"result": "invalid or corrupt torrent file", "arguments": {}}`
+
+	err := client.RemoveTorrents(1, 2)
+	if err == nil || !strings.Contains(err.Error(), "invalid or corrupt torrent file") {
+		t.Errorf("got %v", err)
+	}
+
+	var arguments struct {
+		IDs             []int `json:"ids"`
+		DeleteLocalData bool  `json:"delete-local-data"`
+	}
+	json.Unmarshal(fake.request("torrent-remove"), &arguments)
+	if len(arguments.IDs) != 2 || arguments.DeleteLocalData {
+		t.Errorf("got %+v", arguments)
+	}
+}
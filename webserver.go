@@ -15,6 +15,7 @@ var tmpls *template.Template
 var projects map[string]*Project
 var projectsById []Project
 var projectsGrouped ProjectsGrouped
+var syncStatus RSYNCStatus
 var dataLock = &sync.RWMutex{}
 
 func init() {
@@ -23,6 +24,7 @@ func init() {
 		"safeJS": func(s interface{}) template.JS {
 			return template.JS(fmt.Sprint(s))
 		},
+		"humanBytes": BytesToHumanReadableSize,
 	}).ParseGlob("templates/*.gohtml"))
 
 	logging.Info(tmpls.DefinedTemplates())
@@ -54,25 +56,184 @@ func handleHistory(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// popularShown is how many downloads are shown in each leaderboard
+const popularShown = 10
+
+// ProjectsPage is the data for the /projects page
+type ProjectsPage struct {
+	ProjectsGrouped
+	// The most popular downloads of the week across every project
+	Popular DownloadLeaders
+}
+
 func handleProjects(w http.ResponseWriter, r *http.Request) {
+	var page ProjectsPage
+	_, page.Popular, _, _ = downloadLeaders("total", popularShown)
+
 	dataLock.RLock()
-	err := tmpls.ExecuteTemplate(w, "projects.gohtml", projectsGrouped)
+	page.ProjectsGrouped = projectsGrouped
+	err := tmpls.ExecuteTemplate(w, "projects.gohtml", page)
 	dataLock.RUnlock()
 	if err != nil {
 		logging.Warn("handleProjects,", projects, err)
 	}
 }
 
+// StatusPage is the data for the /projects/{project}/status page
+type StatusPage struct {
+	Project     *Project
+	Rsync       bool
+	LastSuccess *Status
+	LastFailure *Status
+	// History is newest first
+	History []Status
+}
+
+// The /projects/{project}/status page
+func handleProjectStatus(w http.ResponseWriter, r *http.Request) {
+	short := mux.Vars(r)["project"]
+
+	dataLock.RLock()
+	project, ok := projects[short]
+	status := syncStatus
+	dataLock.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := StatusPage{
+		Project: project,
+		Rsync:   project.SyncStyle == "rsync",
+	}
+
+	history := status.History(short)
+	for i := len(history) - 1; i >= 0; i-- {
+		page.History = append(page.History, history[i])
+	}
+	if success, ok := status.LastSuccess(short); ok {
+		page.LastSuccess = &success
+	}
+	if failure, ok := status.LastFailure(short); ok {
+		page.LastFailure = &failure
+	}
+
+	err := tmpls.ExecuteTemplate(w, "status.gohtml", page)
+	if err != nil {
+		logging.Warn("handleProjectStatus;", err)
+	}
+}
+
+// GeoPage is the data for the /projects/{project}/geo page
+type GeoPage struct {
+	Name     string
+	Tracking bool
+	GeoSummary
+}
+
+// The /projects/{project}/geo page shows where a project's traffic came from over the last month
+func handleProjectGeo(w http.ResponseWriter, r *http.Request) {
+	short := mux.Vars(r)["project"]
+
+	page := GeoPage{Name: "All projects"}
+	if short != "total" {
+		dataLock.RLock()
+		project, ok := projects[short]
+		dataLock.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		page.Name = project.Name
+	}
+
+	page.GeoSummary, _, page.Tracking = geoSummary(short)
+
+	err := tmpls.ExecuteTemplate(w, "geo.gohtml", page)
+	if err != nil {
+		logging.Warn("handleProjectGeo;", err)
+	}
+}
+
+// DistroStatsRow is one row of the /stats page
+type DistroStatsRow struct {
+	Distro   string
+	Name     string
+	Requests int64
+	Sent     int64
+	Rsync    NetStat
+	// Requests from each network in StatsPage.Networks
+	Networks []int64
+	Statuses StatusClasses
+	NotFound []TopKEntry
+	// Requests of each class in StatsPage.AgentClasses
+	Agents []int64
+}
+
+// ErrorPercent is the percentage of responses that were 4xx or 5xx
+func (row DistroStatsRow) ErrorPercent() string {
+	return fmt.Sprintf("%.1f%%", 100*row.Statuses.ErrorRate())
+}
+
+// StatsPage is the data for the /stats page
+type StatsPage struct {
+	Tracking     bool
+	Distros      []DistroStatsRow
+	Networks     []string
+	AgentClasses []string
+	Crawlers     []CrawlerActivity
+}
+
 // The /stats page
 func handleStats(w http.ResponseWriter, r *http.Request) {
-	// get bar chart data
-	line, err := QueryWeeklyNetStats()
-	if err != nil {
-		logging.Warn("handleStats;", err)
-		return
+	page := StatsPage{AgentClasses: agentClassifier.Classes()}
+
+	dataLock.RLock()
+	rows := make([]DistroStatsRow, 0, len(projectsById)+2)
+	for _, project := range projectsById {
+		rows = append(rows, DistroStatsRow{Distro: project.Short, Name: project.Name})
+	}
+	dataLock.RUnlock()
+	rows = append(rows, DistroStatsRow{Distro: "other", Name: "Other"}, DistroStatsRow{Distro: "total", Name: "Total"})
+
+	statistics.RLock()
+	if statistics.nginx != nil {
+		page.Tracking = true
+		for _, group := range statistics.networkGroups {
+			page.Networks = append(page.Networks, group.Name)
+		}
+		for _, row := range rows {
+			if stat, ok := statistics.nginx[row.Distro]; ok {
+				row.Requests = stat.Requests
+				row.Sent = stat.BytesSent
+			}
+			if stat, ok := statistics.rsyncd[row.Distro]; ok {
+				row.Rsync = *stat
+			}
+			for _, name := range page.Networks {
+				var requests int64
+				if stat, ok := statistics.networks[name][row.Distro]; ok {
+					requests = stat.Requests
+				}
+				row.Networks = append(row.Networks, requests)
+			}
+			if classes, ok := statistics.statuses[row.Distro]; ok {
+				row.Statuses = *classes
+			}
+			if notFound, ok := statistics.notFound[row.Distro]; ok {
+				row.NotFound = notFound.Top(notFoundShown)
+			}
+			for _, class := range page.AgentClasses {
+				row.Agents = append(row.Agents, statistics.agents[row.Distro][class])
+			}
+			page.Distros = append(page.Distros, row)
+		}
+		page.Crawlers = statistics.crawlers.Activity()
 	}
+	statistics.RUnlock()
 
-	err = tmpls.ExecuteTemplate(w, "statistics.gohtml", line)
+	err := tmpls.ExecuteTemplate(w, "statistics.gohtml", page)
 	if err != nil {
 		logging.Warn("handleStats;", err)
 	}
@@ -144,7 +305,9 @@ func handleManualSyncs(manual chan<- string) http.HandlerFunc {
 
 		if projectName == "all" {
 			// Trigger a sync for every project
-			if token == pullToken {
+			if isPullToken(token) {
+				audit(r, "sync", "all", "master")
+
 				// Return a success message
 				fmt.Fprintf(w, "Sync requested for <i>all</i> projects")
 
@@ -165,7 +328,9 @@ func handleManualSyncs(manual chan<- string) http.HandlerFunc {
 				return
 			}
 
-			if token == pullToken || token == project.AccessToken {
+			if name, ok := validToken(project, token); ok {
+				audit(r, "sync", projectName, name)
+
 				// Return a success message
 				fmt.Fprintf(w, "Sync requested for project: %s", projectName)
 
@@ -179,6 +344,76 @@ func handleManualSyncs(manual chan<- string) http.HandlerFunc {
 	}
 }
 
+// handleManualTorrents is an endpoint that starts scraping and syncing torrents without waiting for the schedule
+// Only the master pull token is accepted
+// /torrents/sync?token={token}
+func handleManualTorrents(manual chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if manual == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// Get the access token
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "No token provided", http.StatusBadRequest)
+			return
+		}
+
+		if !isPullToken(token) {
+			http.Error(w, "Invalid access token", http.StatusForbidden)
+			return
+		}
+		audit(r, "torrent sync", "torrents", "master")
+
+		// The scheduler isn't listening while it restarts after a reload
+		select {
+		case manual <- struct{}{}:
+			fmt.Fprintf(w, "Torrent sync requested")
+			logging.InfoToDiscord("Manual torrent sync requested")
+		default:
+			http.Error(w, "The torrent scheduler is busy, try again later", http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// handleCancelSync is an endpoint that allows a privileged user to stop a project's running sync
+// The same tokens that can start a sync can cancel it
+// /sync/{project}/cancel?token={token}
+func handleCancelSync(w http.ResponseWriter, r *http.Request) {
+	projectName := mux.Vars(r)["project"]
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "No token provided", http.StatusBadRequest)
+		return
+	}
+
+	dataLock.RLock()
+	project, ok := projects[projectName]
+	dataLock.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	name, ok := validToken(project, token)
+	if !ok {
+		http.Error(w, "Invalid access token", http.StatusForbidden)
+		return
+	}
+
+	if !cancelSync(projectName) {
+		http.Error(w, "Project is not syncing", http.StatusConflict)
+		return
+	}
+
+	audit(r, "cancel", projectName, name)
+	fmt.Fprintf(w, "Cancelled sync for project: %s", projectName)
+	logging.InfoToDiscord("Sync cancelled for project: _", projectName, "_")
+}
+
 // Always returns status OK with no other content
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -193,10 +428,19 @@ func WebserverLoadConfig(config *ConfigFile) {
 	dataLock.Unlock()
 }
 
+// WebserverLoadSyncStatus replaces the sync history served by the api
+// status should be nil when the scheduler is not running
+func WebserverLoadSyncStatus(status RSYNCStatus) {
+	dataLock.Lock()
+	syncStatus = status
+	dataLock.Unlock()
+}
+
 // HandleWebserver starts the webserver and listens for incoming connections
 // manual is a channel that project short names are sent down to manually trigger a projects rsync
+// torrentManual starts a torrent run, it is nil when torrents are disabled
 // entries is a channel that contains log entries that are disabled by the mirror map
-func HandleWebserver(manual chan<- string, entries chan *NginxLogEntry) {
+func HandleWebserver(manual chan<- string, torrentManual chan<- struct{}, entries chan *NginxLogEntry) {
 	r := mux.NewRouter()
 
 	cache = make(map[string]*CacheEntry)
@@ -212,13 +456,25 @@ func HandleWebserver(manual chan<- string, entries chan *NginxLogEntry) {
 	r.Handle("/", http.RedirectHandler("/home", http.StatusTemporaryRedirect))
 	r.Handle("/home", cachingMiddleware(handleHome))
 	r.Handle("/projects", cachingMiddleware(handleProjects))
+	r.HandleFunc("/projects/{project}/status", handleProjectStatus)
+	r.HandleFunc("/projects/{project}/geo", handleProjectGeo)
 	r.Handle("/history", cachingMiddleware(handleHistory))
 	r.Handle("/stats/{project}/{statistic}", cachingMiddleware(handleStatistics))
-	r.Handle("/stats", cachingMiddleware(handleStats))
+	r.HandleFunc("/stats", handleStats)
 	r.Handle("/sync/{project}", handleManualSyncs(manual))
+	r.HandleFunc("/sync/{project}/cancel", handleCancelSync)
+	r.HandleFunc("/sync/{project}/log", handleSyncLog)
+	r.Handle("/torrents/sync", handleManualTorrents(torrentManual))
 	r.HandleFunc("/health", handleHealth)
 	r.HandleFunc("/ws", HandleWebsocket)
 
+	if prometheusMetrics {
+		r.HandleFunc("/metrics", handleMetrics)
+	}
+
+	// JSON api
+	HandleAPI(r.PathPrefix("/api").Subrouter())
+
 	// Static files
 	r.PathPrefix("/").Handler(cachingMiddleware(http.FileServer(http.Dir("static")).ServeHTTP))
 